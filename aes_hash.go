@@ -29,12 +29,9 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package randomx
 
-import "fmt"
 import "math/bits"
 import "encoding/binary"
 
-var tmp_______ = fmt.Sprintf("dd")
-
 var AES_HASH_1R_STATE0 = ARRAY_TO_BIGENDIAN([4]uint32{0xd7983aad, 0xcc82db47, 0x9fa856de, 0x92b52c0d})
 var AES_HASH_1R_STATE1 = ARRAY_TO_BIGENDIAN([4]uint32{0xace78057, 0xf59e125a, 0x15c7b798, 0x338d996e})
 var AES_HASH_1R_STATE2 = ARRAY_TO_BIGENDIAN([4]uint32{0xe8a07ce4, 0x5079506b, 0xae62c7d0, 0x6a770017})
@@ -81,9 +78,60 @@ func hashAes1Rx4(input []byte, output []byte) {
 	for i := 0; i < 63; i += 4 {
 		binary.BigEndian.PutUint32(output[i:], states[i/16][(i%16)/4])
 	}
+}
+
+// hashAes1Rx4 of scratchpad into output and fillAes1Rx4 of scratchpad from fill_state in a single pass
+// every 64 byte block is hashed before it is overwritten, used to pipeline consecutive hashes
+func hashAndFillAes1Rx4(scratchpad []byte, output []byte, fill_state []byte) {
+
+	var states [4][4]uint32
+	for i := range states {
+		states[0][i] = AES_HASH_1R_STATE0[i]
+		states[1][i] = AES_HASH_1R_STATE1[i]
+		states[2][i] = AES_HASH_1R_STATE2[i]
+		states[3][i] = AES_HASH_1R_STATE3[i]
+	}
+
+	var fill [4][4]uint32
+	for i := 0; i < 63; i += 4 {
+		fill[i/16][(i%16)/4] = binary.BigEndian.Uint32(fill_state[i:])
+	}
+
+	var in [4][4]uint32
+	for ptr := 0; ptr < len(scratchpad); ptr += 64 {
+		for i := 0; i < 63; i += 4 { // load 64 bytes
+			in[i/16][(i%16)/4] = binary.LittleEndian.Uint32(scratchpad[ptr+i:])
+		}
+
+		AES_ENC_ROUND(states[0][:], in[0][:])
+		AES_DEC_ROUND(states[1][:], in[1][:])
+		AES_ENC_ROUND(states[2][:], in[2][:])
+		AES_DEC_ROUND(states[3][:], in[3][:])
+
+		AES_DEC_ROUND(fill[0][:], AES_GEN_1R_KEY0[:])
+		AES_ENC_ROUND(fill[1][:], AES_GEN_1R_KEY1[:])
+		AES_DEC_ROUND(fill[2][:], AES_GEN_1R_KEY2[:])
+		AES_ENC_ROUND(fill[3][:], AES_GEN_1R_KEY3[:])
+
+		for i := 0; i < 63; i += 4 {
+			binary.LittleEndian.PutUint32(scratchpad[ptr+i:], fill[i/16][(i%16)/4])
+		}
+	}
+
+	AES_ENC_ROUND(states[0][:], AES_HASH_1R_XKEY0[:])
+	AES_DEC_ROUND(states[1][:], AES_HASH_1R_XKEY0[:])
+	AES_ENC_ROUND(states[2][:], AES_HASH_1R_XKEY0[:])
+	AES_DEC_ROUND(states[3][:], AES_HASH_1R_XKEY0[:])
 
-	fmt.Printf("aes hash %x\n", output)
+	AES_ENC_ROUND(states[0][:], AES_HASH_1R_XKEY1[:])
+	AES_DEC_ROUND(states[1][:], AES_HASH_1R_XKEY1[:])
+	AES_ENC_ROUND(states[2][:], AES_HASH_1R_XKEY1[:])
+	AES_DEC_ROUND(states[3][:], AES_HASH_1R_XKEY1[:])
 
+	for i := 0; i < 63; i += 4 {
+		binary.BigEndian.PutUint32(output[i:], states[i/16][(i%16)/4])
+		binary.BigEndian.PutUint32(fill_state[i:], fill[i/16][(i%16)/4])
+	}
 }
 
 // these keys are used to generate scratchpad
@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "runtime"
+import "unsafe"
+
+// Allocation reports how the memory of a cache, dataset or VM scratchpad was obtained
+type Allocation struct {
+	Size        uint64 // bytes
+	LargePages  bool   // backed by reserved huge pages ( MAP_HUGETLB )
+	Transparent bool   // transparent huge pages were requested for ordinary pages
+	Locked      bool   // pinned in RAM, never swapped out
+
+	// why a feature requested with RANDOMX_FLAG_LARGE_PAGES or RANDOMX_FLAG_LOCK_MEMORY is not in use, empty if all were granted
+	Fallback string
+}
+
+// memory holds a large buffer obtained from allocMemory
+// it is returned to the operating system by free, or by the garbage collector once unreachable
+// slices of the buffer must not be used after free
+type memory struct {
+	Allocation
+	data    []byte
+	release func() error // unmaps data, nil for buffers on the go heap
+}
+
+// allocate size zeroed bytes, honoring RANDOMX_FLAG_LARGE_PAGES and RANDOMX_FLAG_LOCK_MEMORY where possible
+// it never fails, when the operating system refuses a feature the memory is obtained without it and Fallback tells why
+func allocMemory(size uint64, flags Flags) *memory {
+	return managed(osAlloc(size, flags))
+}
+
+// wrap words mapped from a file by mapWords or mapSharedWords, release is nil for words read onto the go heap
+func mappedMemory(words []uint64, release func() error) *memory {
+	data := unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(words))), len(words)*8)
+	return managed(&memory{Allocation: Allocation{Size: uint64(len(data))}, data: data, release: release})
+}
+
+// mapped memory is released by the garbage collector once m is unreachable
+// owners exporting slices of m keep themselves alive with runtime.KeepAlive until the slices are no longer used
+func managed(m *memory) *memory {
+	if m.release != nil {
+		runtime.SetFinalizer(m, (*memory).free)
+	}
+	return m
+}
+
+// memory on the go heap, word aligned
+func heapAlloc(size uint64) *memory {
+	words := make([]uint64, (size+7)/8)
+	return &memory{Allocation: Allocation{Size: size}, data: unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), size)}
+}
+
+// return the buffer to the operating system, further calls do nothing
+func (m *memory) free() error {
+	if m == nil {
+		return nil
+	}
+	m.data = nil
+	if release := m.release; release != nil {
+		m.release = nil
+		runtime.SetFinalizer(m, nil)
+		return release()
+	}
+	return nil
+}
+
+// buffer viewed as words, size must be a multiple of 8
+func (m *memory) words() []uint64 {
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&m.data[0])), len(m.data)/8)
+}
+
+// buffer viewed as argon2 blocks, size must be a multiple of the block size
+func (m *memory) blocks() []block {
+	return unsafe.Slice((*block)(unsafe.Pointer(&m.data[0])), len(m.data)/int(ArgonBlockSize))
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "strings"
+import "syscall"
+
+// reserved huge pages are 2 MiB on the platforms this matters for, mappings are rounded up to it
+const hugePageSize = 2 << 20
+
+// anonymous private mappings, so memory is returned on free instead of at the next garbage collection
+// with RANDOMX_FLAG_LARGE_PAGES reserved huge pages are tried first, then transparent huge pages
+func osAlloc(size uint64, flags Flags) *memory {
+	var reasons []string
+	var m *memory
+
+	if flags&RANDOMX_FLAG_LARGE_PAGES != 0 {
+		length := (size + hugePageSize - 1) &^ (hugePageSize - 1)
+		data, err := syscall.Mmap(-1, 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_HUGETLB)
+		if err == nil {
+			m = &memory{Allocation: Allocation{Size: size, LargePages: true}, data: data[:size], release: func() error { return syscall.Munmap(data) }}
+		} else {
+			reasons = append(reasons, "MAP_HUGETLB: "+err.Error())
+		}
+	}
+
+	if m == nil {
+		data, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+		if err == nil {
+			m = &memory{Allocation: Allocation{Size: size}, data: data, release: func() error { return syscall.Munmap(data) }}
+			if flags&RANDOMX_FLAG_LARGE_PAGES != 0 {
+				if err := syscall.Madvise(data, syscall.MADV_HUGEPAGE); err == nil {
+					m.Transparent = true
+				} else {
+					reasons = append(reasons, "MADV_HUGEPAGE: "+err.Error())
+				}
+			}
+		} else {
+			reasons = append(reasons, "mmap: "+err.Error())
+			m = heapAlloc(size)
+		}
+	}
+
+	if flags&RANDOMX_FLAG_LOCK_MEMORY != 0 {
+		if m.release == nil {
+			reasons = append(reasons, "mlock: memory is not mapped")
+		} else if err := syscall.Mlock(m.data); err == nil {
+			m.Locked = true
+		} else {
+			reasons = append(reasons, "mlock: "+err.Error())
+		}
+	}
+
+	m.Fallback = strings.Join(reasons, ", ")
+	return m
+}
@@ -0,0 +1,314 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "fmt"
+import "context"
+import "sync"
+import "math/bits"
+import "encoding/binary"
+import "golang.org/x/crypto/blake2b"
+
+// Argon2d as specified by RFC 9106, version 0x13. RandomX only needs the filled block memory
+// so the filler works on memory supplied by the caller and the final tag is only computed for tests
+
+const argon2Version = 0x13
+const argon2d = 0 // type y of the specification
+
+// a 1 KiB block of argon2 memory, as 128 little endian words
+type block [128]uint64
+
+// every lane is split in this many segments, lanes synchronize after each of them
+const syncPoints = 4
+
+// fill B, whose length is the memory size in blocks, so the caller decides where the blocks live
+// the RANDOMX_FLAG_ARGON2 bits of flags select the implementation of the compression function
+// progress, when not nil, is called after every slice with the slices done out of time * syncPoints
+// the fill stops with ctx.Err() at the first slice boundary after ctx is cancelled
+func buildBlocks(ctx context.Context, B []block, flags Flags, progress func(done, total uint64), password, salt, secret, data []byte, time uint32, threads uint8, keyLen uint32) error {
+	if time < 1 {
+		return fmt.Errorf("%w: number of rounds too small", ErrInvalidArgon2Params)
+	}
+	if threads < 1 {
+		return fmt.Errorf("%w: parallelism degree too low", ErrInvalidArgon2Params)
+	}
+	memory := uint32(len(B))
+	if memory%(syncPoints*uint32(threads)) != 0 || memory < 2*syncPoints*uint32(threads) {
+		return fmt.Errorf("%w: memory is not a multiple of lanes and sync points", ErrInvalidArgon2Params)
+	}
+	h0 := initHash(password, salt, secret, data, time, memory, uint32(threads), keyLen)
+
+	initBlocks(B, &h0, uint32(threads))
+	return processBlocks(ctx, B, time, uint32(threads), threads > 1, blamkaFor(flags), progress)
+}
+
+// H0 of the specification, followed by room for the block and lane numbers
+func initHash(password, salt, secret, data []byte, time, memory, threads, keyLen uint32) (h0 [blake2b.Size + 8]byte) {
+	var params [24]byte
+	binary.LittleEndian.PutUint32(params[0:], threads)
+	binary.LittleEndian.PutUint32(params[4:], keyLen)
+	binary.LittleEndian.PutUint32(params[8:], memory)
+	binary.LittleEndian.PutUint32(params[12:], time)
+	binary.LittleEndian.PutUint32(params[16:], argon2Version)
+	binary.LittleEndian.PutUint32(params[20:], argon2d)
+
+	h, _ := blake2b.New512(nil)
+	h.Write(params[:])
+	for _, input := range [][]byte{password, salt, secret, data} {
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(input)))
+		h.Write(length[:])
+		h.Write(input)
+	}
+	h.Sum(h0[:0])
+	return
+}
+
+// variable length hash H' of the specification
+func blake2bLong(out []byte, in []byte) {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(out)))
+
+	if len(out) <= blake2b.Size {
+		h, _ := blake2b.New(len(out), nil)
+		h.Write(length[:])
+		h.Write(in)
+		h.Sum(out[:0])
+		return
+	}
+
+	// every intermediate hash contributes its first half, the last one is as long as what remains
+	var v [blake2b.Size]byte
+	h, _ := blake2b.New512(nil)
+	h.Write(length[:])
+	h.Write(in)
+	h.Sum(v[:0])
+	copy(out, v[:32])
+	out = out[32:]
+	for len(out) > blake2b.Size {
+		v = blake2b.Sum512(v[:])
+		copy(out, v[:32])
+		out = out[32:]
+	}
+	h, _ = blake2b.New(len(out), nil)
+	h.Write(v[:])
+	h.Sum(out[:0])
+}
+
+// first two blocks of every lane are derived from h0
+func initBlocks(B []block, h0 *[blake2b.Size + 8]byte, threads uint32) {
+	var block0 [ArgonBlockSize]byte
+	lane_length := uint32(len(B)) / threads
+	for lane := uint32(0); lane < threads; lane++ {
+		binary.LittleEndian.PutUint32(h0[blake2b.Size+4:], lane)
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2b.Size:], i)
+			blake2bLong(block0[:], h0[:])
+			b := &B[lane*lane_length+i]
+			for j := range b {
+				b[j] = binary.LittleEndian.Uint64(block0[j*8:])
+			}
+		}
+	}
+}
+
+// run time passes over the memory, one segment of every lane per sync point
+// segments of a slice only reference blocks outside the slice in other lanes, so with parallel
+// they are filled on one goroutine per lane and the memory is the same as when filled in order
+func processBlocks(ctx context.Context, B []block, time, threads uint32, parallel bool, permute func(q *block), progress func(done, total uint64)) error {
+	var wg sync.WaitGroup
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if parallel {
+				wg.Add(int(threads))
+				for lane := uint32(0); lane < threads; lane++ {
+					go func() {
+						defer wg.Done()
+						processSegment(B, pass, slice, lane, threads, permute)
+					}()
+				}
+				wg.Wait()
+			} else {
+				for lane := uint32(0); lane < threads; lane++ {
+					processSegment(B, pass, slice, lane, threads, permute)
+				}
+			}
+			if progress != nil {
+				progress(uint64(pass*syncPoints+slice+1), uint64(time*syncPoints))
+			}
+		}
+	}
+	return nil
+}
+
+// fill one segment, every block depends on the previous one and on a block chosen by the previous one ( data dependent addressing )
+func processSegment(B []block, pass, slice, lane, threads uint32, permute func(q *block)) {
+	lane_length := uint32(len(B)) / threads
+	segment_length := lane_length / syncPoints
+
+	index := uint32(0)
+	if pass == 0 && slice == 0 {
+		index = 2 // first blocks come from initBlocks
+	}
+	offset := lane*lane_length + slice*segment_length + index
+	for ; index < segment_length; index, offset = index+1, offset+1 {
+		prev := offset - 1
+		if index == 0 && slice == 0 {
+			prev += lane_length // previous block of the first one is the last one of the lane
+		}
+		ref := referenceBlock(B[prev][0], lane_length, segment_length, threads, pass, slice, lane, index)
+		processBlock(&B[offset], &B[prev], &B[ref], pass > 0, permute)
+	}
+}
+
+// index of the block mixed into block index of a segment, chosen by the first word of the previous block
+func referenceBlock(rand uint64, lane_length, segment_length, threads, pass, slice, lane, index uint32) uint32 {
+	ref_lane := uint32(rand>>32) % threads
+	if pass == 0 && slice == 0 {
+		ref_lane = lane
+	}
+
+	// area of the lane which may be referenced, it starts at start and is size blocks long
+	size, start := 3*segment_length, ((slice+1)%syncPoints)*segment_length
+	if lane == ref_lane {
+		size += index
+	}
+	if pass == 0 {
+		size, start = slice*segment_length, 0
+		if slice == 0 || lane == ref_lane {
+			size += index
+		}
+	}
+	if index == 0 || lane == ref_lane {
+		size-- // the previous block is excluded
+	}
+
+	// nonuniform mapping favoring recent blocks
+	x := rand & 0xffffffff
+	x = (x * x) >> 32
+	x = (x * uint64(size)) >> 32
+	return ref_lane*lane_length + uint32((uint64(start)+uint64(size)-(x+1))%uint64(lane_length))
+}
+
+// compression function G, with xor the result is combined with the old contents of out ( passes after the first )
+func processBlock(out, in1, in2 *block, xor bool, permute func(q *block)) {
+	var r, q block
+	for i := range r {
+		r[i] = in1[i] ^ in2[i]
+	}
+	q = r
+	permute(&q)
+
+	if xor {
+		for i := range out {
+			out[i] ^= r[i] ^ q[i]
+		}
+	} else {
+		for i := range out {
+			out[i] = r[i] ^ q[i]
+		}
+	}
+}
+
+// portable permutation of a block, rows of 16 words are permuted by blamka, then columns made of word pairs
+// the assembly versions compute the same with vector registers
+func blamkaGeneric(q *block) {
+	for i := 0; i < 128; i += 16 {
+		blamka(&q[i], &q[i+1], &q[i+2], &q[i+3], &q[i+4], &q[i+5], &q[i+6], &q[i+7],
+			&q[i+8], &q[i+9], &q[i+10], &q[i+11], &q[i+12], &q[i+13], &q[i+14], &q[i+15])
+	}
+	for i := 0; i < 16; i += 2 {
+		blamka(&q[i], &q[i+1], &q[16+i], &q[16+i+1], &q[32+i], &q[32+i+1], &q[48+i], &q[48+i+1],
+			&q[64+i], &q[64+i+1], &q[80+i], &q[80+i+1], &q[96+i], &q[96+i+1], &q[112+i], &q[112+i+1])
+	}
+}
+
+// permutation P, a blake2b round whose additions are replaced by fBlaMka
+func blamka(t00, t01, t02, t03, t04, t05, t06, t07, t08, t09, t10, t11, t12, t13, t14, t15 *uint64) {
+	v00, v01, v02, v03 := *t00, *t01, *t02, *t03
+	v04, v05, v06, v07 := *t04, *t05, *t06, *t07
+	v08, v09, v10, v11 := *t08, *t09, *t10, *t11
+	v12, v13, v14, v15 := *t12, *t13, *t14, *t15
+
+	v00, v04, v08, v12 = blamkaG(v00, v04, v08, v12)
+	v01, v05, v09, v13 = blamkaG(v01, v05, v09, v13)
+	v02, v06, v10, v14 = blamkaG(v02, v06, v10, v14)
+	v03, v07, v11, v15 = blamkaG(v03, v07, v11, v15)
+
+	v00, v05, v10, v15 = blamkaG(v00, v05, v10, v15)
+	v01, v06, v11, v12 = blamkaG(v01, v06, v11, v12)
+	v02, v07, v08, v13 = blamkaG(v02, v07, v08, v13)
+	v03, v04, v09, v14 = blamkaG(v03, v04, v09, v14)
+
+	*t00, *t01, *t02, *t03 = v00, v01, v02, v03
+	*t04, *t05, *t06, *t07 = v04, v05, v06, v07
+	*t08, *t09, *t10, *t11 = v08, v09, v10, v11
+	*t12, *t13, *t14, *t15 = v12, v13, v14, v15
+}
+
+func blamkaG(a, b, c, d uint64) (uint64, uint64, uint64, uint64) {
+	a = fBlaMka(a, b)
+	d = bits.RotateLeft64(d^a, -32)
+	c = fBlaMka(c, d)
+	b = bits.RotateLeft64(b^c, -24)
+	a = fBlaMka(a, b)
+	d = bits.RotateLeft64(d^a, -16)
+	c = fBlaMka(c, d)
+	b = bits.RotateLeft64(b^c, -63)
+	return a, b, c, d
+}
+
+// addition hardened with a 32 bit multiplication
+func fBlaMka(x, y uint64) uint64 {
+	return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+}
+
+// tag of a filled memory, the last blocks of all lanes are combined and hashed to keyLen bytes
+// RandomX does not use it, it checks the filler against the test vectors of the specification
+func extractKey(B []block, threads, keyLen uint32) []byte {
+	lane_length := uint32(len(B)) / threads
+	final := B[lane_length-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		for i, v := range B[lane*lane_length+lane_length-1] {
+			final[i] ^= v
+		}
+	}
+
+	var buf [ArgonBlockSize]byte
+	for i, v := range final {
+		binary.LittleEndian.PutUint64(buf[i*8:], v)
+	}
+	key := make([]byte, keyLen)
+	blake2bLong(key, buf[:])
+	return key
+}
@@ -0,0 +1,63 @@
+//go:build amd64 && gc && !purego
+
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "golang.org/x/sys/cpu"
+
+// permutations of argon2 blocks in blamka_amd64.s
+//
+//go:noescape
+func blamkaSSSE3(q *block)
+
+//go:noescape
+func blamkaAVX2(q *block)
+
+func init() {
+	if cpu.X86.HasSSSE3 {
+		supportedFlags |= RANDOMX_FLAG_ARGON2_SSSE3
+	}
+	if cpu.X86.HasAVX2 {
+		supportedFlags |= RANDOMX_FLAG_ARGON2_AVX2
+	}
+}
+
+// permutation for cache flags, AVX2 is preferred when both ARGON2 flags are set as in the reference
+func blamkaFor(flags Flags) func(q *block) {
+	flags &= supportedFlags
+	switch {
+	case flags&RANDOMX_FLAG_ARGON2_AVX2 != 0:
+		return blamkaAVX2
+	case flags&RANDOMX_FLAG_ARGON2_SSSE3 != 0:
+		return blamkaSSSE3
+	}
+	return blamkaGeneric
+}
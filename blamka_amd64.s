@@ -0,0 +1,252 @@
+//go:build amd64 && gc && !purego
+
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+#include "textflag.h"
+
+// byte shuffles rotating every 64 bit word right by 24 and 16 bits, repeated for both lanes of a ymm register
+DATA ·rot24<>+0x00(SB)/8, $0x0201000706050403
+DATA ·rot24<>+0x08(SB)/8, $0x0a09080f0e0d0c0b
+DATA ·rot24<>+0x10(SB)/8, $0x0201000706050403
+DATA ·rot24<>+0x18(SB)/8, $0x0a09080f0e0d0c0b
+GLOBL ·rot24<>(SB), (NOPTR+RODATA), $32
+
+DATA ·rot16<>+0x00(SB)/8, $0x0100070605040302
+DATA ·rot16<>+0x08(SB)/8, $0x09080f0e0d0c0b0a
+DATA ·rot16<>+0x10(SB)/8, $0x0100070605040302
+DATA ·rot16<>+0x18(SB)/8, $0x09080f0e0d0c0b0a
+GLOBL ·rot16<>(SB), (NOPTR+RODATA), $32
+
+// a += b + 2 * lo32(a) * lo32(b), t is clobbered
+#define FBLAMKA(a, b, t) \
+	MOVO    a, t; \
+	PMULULQ b, t; \
+	PADDQ   b, a; \
+	PADDQ   t, a; \
+	PADDQ   t, a
+
+// blamka G on two columns of words held in a, b, c and d
+#define G(a, b, c, d) \
+	FBLAMKA(a, b, X8); \
+	PXOR    a, d; \
+	PSHUFD  $0xb1, d, d; \
+	FBLAMKA(c, d, X8); \
+	PXOR    c, b; \
+	PSHUFB  X9, b; \
+	FBLAMKA(a, b, X8); \
+	PXOR    a, d; \
+	PSHUFB  X10, d; \
+	FBLAMKA(c, d, X8); \
+	PXOR    c, b; \
+	MOVO    b, X8; \
+	PADDQ   b, X8; \
+	PSRLQ   $63, b; \
+	PXOR    X8, b
+
+// blamka on the 16 words at the given offsets of the block in AX, 2 words per offset
+#define ROUND(o0, o1, o2, o3, o4, o5, o6, o7) \
+	MOVOU   o0(AX), X0; \
+	MOVOU   o1(AX), X1; \
+	MOVOU   o2(AX), X2; \
+	MOVOU   o3(AX), X3; \
+	MOVOU   o4(AX), X4; \
+	MOVOU   o5(AX), X5; \
+	MOVOU   o6(AX), X6; \
+	MOVOU   o7(AX), X7; \
+	G(X0, X2, X4, X6); \
+	G(X1, X3, X5, X7); \
+	MOVO    X3, X11; \
+	PALIGNR $8, X2, X11; \
+	MOVO    X2, X12; \
+	PALIGNR $8, X3, X12; \
+	MOVO    X6, X13; \
+	PALIGNR $8, X7, X13; \
+	MOVO    X7, X14; \
+	PALIGNR $8, X6, X14; \
+	G(X0, X11, X5, X13); \
+	G(X1, X12, X4, X14); \
+	MOVO    X11, X2; \
+	PALIGNR $8, X12, X2; \
+	MOVO    X12, X3; \
+	PALIGNR $8, X11, X3; \
+	MOVO    X14, X6; \
+	PALIGNR $8, X13, X6; \
+	MOVO    X13, X7; \
+	PALIGNR $8, X14, X7; \
+	MOVOU   X0, o0(AX); \
+	MOVOU   X1, o1(AX); \
+	MOVOU   X2, o2(AX); \
+	MOVOU   X3, o3(AX); \
+	MOVOU   X4, o4(AX); \
+	MOVOU   X5, o5(AX); \
+	MOVOU   X6, o6(AX); \
+	MOVOU   X7, o7(AX)
+
+#define ROW(o) ROUND(o, o+16, o+32, o+48, o+64, o+80, o+96, o+112)
+#define COLUMN(o) ROUND(o, o+128, o+256, o+384, o+512, o+640, o+768, o+896)
+
+// func blamkaSSSE3(q *block)
+TEXT ·blamkaSSSE3(SB), NOSPLIT, $0-8
+	MOVQ  q+0(FP), AX
+	MOVOU ·rot24<>(SB), X9
+	MOVOU ·rot16<>(SB), X10
+
+	ROW(0)
+	ROW(128)
+	ROW(256)
+	ROW(384)
+	ROW(512)
+	ROW(640)
+	ROW(768)
+	ROW(896)
+
+	COLUMN(0)
+	COLUMN(16)
+	COLUMN(32)
+	COLUMN(48)
+	COLUMN(64)
+	COLUMN(80)
+	COLUMN(96)
+	COLUMN(112)
+	RET
+
+// a += b + 2 * lo32(a) * lo32(b), t is clobbered
+#define FBLAMKA2(a, b, t) \
+	VPMULUDQ b, a, t; \
+	VPADDQ   t, t, t; \
+	VPADDQ   b, a, a; \
+	VPADDQ   t, a, a
+
+// blamka G on four columns of words held in a, b, c and d
+#define G2(a, b, c, d) \
+	FBLAMKA2(a, b, Y8); \
+	VPXOR    a, d, d; \
+	VPSHUFD  $0xb1, d, d; \
+	FBLAMKA2(c, d, Y8); \
+	VPXOR    c, b, b; \
+	VPSHUFB  Y9, b, b; \
+	FBLAMKA2(a, b, Y8); \
+	VPXOR    a, d, d; \
+	VPSHUFB  Y10, d, d; \
+	FBLAMKA2(c, d, Y8); \
+	VPXOR    c, b, b; \
+	VPADDQ   b, b, Y8; \
+	VPSRLQ   $63, b, b; \
+	VPXOR    Y8, b, b
+
+// rotate words of b, c and d so the diagonals line up with a, and back
+#define DIAG(b, c, d) \
+	VPERMQ $0x39, b, b; \
+	VPERMQ $0x4e, c, c; \
+	VPERMQ $0x93, d, d
+
+#define UNDIAG(b, c, d) \
+	VPERMQ $0x93, b, b; \
+	VPERMQ $0x4e, c, c; \
+	VPERMQ $0x39, d, d
+
+// blamka on two sets of 16 words, held in Y0-Y3 and Y4-Y7
+#define ROUND2 \
+	G2(Y0, Y1, Y2, Y3); \
+	G2(Y4, Y5, Y6, Y7); \
+	DIAG(Y1, Y2, Y3); \
+	DIAG(Y5, Y6, Y7); \
+	G2(Y0, Y1, Y2, Y3); \
+	G2(Y4, Y5, Y6, Y7); \
+	UNDIAG(Y1, Y2, Y3); \
+	UNDIAG(Y5, Y6, Y7)
+
+// two consecutive rows of 16 words starting at offset o
+#define ROWS(o) \
+	VMOVDQU o(AX), Y0; \
+	VMOVDQU o+32(AX), Y1; \
+	VMOVDQU o+64(AX), Y2; \
+	VMOVDQU o+96(AX), Y3; \
+	VMOVDQU o+128(AX), Y4; \
+	VMOVDQU o+160(AX), Y5; \
+	VMOVDQU o+192(AX), Y6; \
+	VMOVDQU o+224(AX), Y7; \
+	ROUND2; \
+	VMOVDQU Y0, o(AX); \
+	VMOVDQU Y1, o+32(AX); \
+	VMOVDQU Y2, o+64(AX); \
+	VMOVDQU Y3, o+96(AX); \
+	VMOVDQU Y4, o+128(AX); \
+	VMOVDQU Y5, o+160(AX); \
+	VMOVDQU Y6, o+192(AX); \
+	VMOVDQU Y7, o+224(AX)
+
+// words o, o+128 of a column go to the low and high lane of y
+#define LOADCOL(o, x, y) \
+	VMOVDQU     o(AX), x; \
+	VINSERTI128 $1, o+128(AX), y, y
+
+#define STORECOL(o, x, y) \
+	VMOVDQU      x, o(AX); \
+	VEXTRACTI128 $1, y, o+128(AX)
+
+// two consecutive columns of word pairs starting at offset o
+#define COLUMNS(o) \
+	LOADCOL(o, X0, Y0); \
+	LOADCOL(o+256, X1, Y1); \
+	LOADCOL(o+512, X2, Y2); \
+	LOADCOL(o+768, X3, Y3); \
+	LOADCOL(o+16, X4, Y4); \
+	LOADCOL(o+272, X5, Y5); \
+	LOADCOL(o+528, X6, Y6); \
+	LOADCOL(o+784, X7, Y7); \
+	ROUND2; \
+	STORECOL(o, X0, Y0); \
+	STORECOL(o+256, X1, Y1); \
+	STORECOL(o+512, X2, Y2); \
+	STORECOL(o+768, X3, Y3); \
+	STORECOL(o+16, X4, Y4); \
+	STORECOL(o+272, X5, Y5); \
+	STORECOL(o+528, X6, Y6); \
+	STORECOL(o+784, X7, Y7)
+
+// func blamkaAVX2(q *block)
+TEXT ·blamkaAVX2(SB), NOSPLIT, $0-8
+	MOVQ    q+0(FP), AX
+	VMOVDQU ·rot24<>(SB), Y9
+	VMOVDQU ·rot16<>(SB), Y10
+
+	ROWS(0)
+	ROWS(256)
+	ROWS(512)
+	ROWS(768)
+
+	COLUMNS(0)
+	COLUMNS(32)
+	COLUMNS(64)
+	COLUMNS(96)
+
+	VZEROUPPER
+	RET
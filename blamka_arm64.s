@@ -0,0 +1,127 @@
+//go:build arm64 && gc && !purego
+
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+#include "textflag.h"
+
+// table lookups rotating every 64 bit word right by 24 and 16 bits
+DATA ·rot24<>+0x00(SB)/8, $0x0201000706050403
+DATA ·rot24<>+0x08(SB)/8, $0x0a09080f0e0d0c0b
+GLOBL ·rot24<>(SB), (NOPTR+RODATA), $16
+
+DATA ·rot16<>+0x00(SB)/8, $0x0100070605040302
+DATA ·rot16<>+0x08(SB)/8, $0x09080f0e0d0c0b0a
+GLOBL ·rot16<>(SB), (NOPTR+RODATA), $16
+
+// a += b + 2 * lo32(a) * lo32(b)
+#define FBLAMKA(a, b) \
+	VXTN   a.D2, V16.S2; \
+	VXTN   b.D2, V17.S2; \
+	VADD   b.D2, a.D2, a.D2; \
+	VUMLAL V16.S2, V17.S2, a.D2; \
+	VUMLAL V16.S2, V17.S2, a.D2
+
+// blamka G on two columns of words held in a, b, c and d
+#define G(a, b, c, d) \
+	FBLAMKA(a, b); \
+	VEOR   a.B16, d.B16, d.B16; \
+	VREV64 d.S4, d.S4; \
+	FBLAMKA(c, d); \
+	VEOR   c.B16, b.B16, b.B16; \
+	VTBL   V18.B16, [b.B16], b.B16; \
+	FBLAMKA(a, b); \
+	VEOR   a.B16, d.B16, d.B16; \
+	VTBL   V19.B16, [d.B16], d.B16; \
+	FBLAMKA(c, d); \
+	VEOR   c.B16, b.B16, b.B16; \
+	VADD   b.D2, b.D2, V20.D2; \
+	VUSHR  $63, b.D2, b.D2; \
+	VORR   V20.B16, b.B16, b.B16
+
+// blamka on the 16 words at the given offsets of the block in R0, 2 words per offset
+#define ROUND(o0, o1, o2, o3, o4, o5, o6, o7) \
+	FMOVQ o0(R0), F0; \
+	FMOVQ o1(R0), F1; \
+	FMOVQ o2(R0), F2; \
+	FMOVQ o3(R0), F3; \
+	FMOVQ o4(R0), F4; \
+	FMOVQ o5(R0), F5; \
+	FMOVQ o6(R0), F6; \
+	FMOVQ o7(R0), F7; \
+	G(V0, V2, V4, V6); \
+	G(V1, V3, V5, V7); \
+	VEXT  $8, V3.B16, V2.B16, V12.B16; \
+	VEXT  $8, V2.B16, V3.B16, V13.B16; \
+	VEXT  $8, V6.B16, V7.B16, V14.B16; \
+	VEXT  $8, V7.B16, V6.B16, V15.B16; \
+	G(V0, V12, V5, V14); \
+	G(V1, V13, V4, V15); \
+	VEXT  $8, V12.B16, V13.B16, V2.B16; \
+	VEXT  $8, V13.B16, V12.B16, V3.B16; \
+	VEXT  $8, V15.B16, V14.B16, V6.B16; \
+	VEXT  $8, V14.B16, V15.B16, V7.B16; \
+	FMOVQ F0, o0(R0); \
+	FMOVQ F1, o1(R0); \
+	FMOVQ F2, o2(R0); \
+	FMOVQ F3, o3(R0); \
+	FMOVQ F4, o4(R0); \
+	FMOVQ F5, o5(R0); \
+	FMOVQ F6, o6(R0); \
+	FMOVQ F7, o7(R0)
+
+#define ROW(o) ROUND(o, o+16, o+32, o+48, o+64, o+80, o+96, o+112)
+#define COLUMN(o) ROUND(o, o+128, o+256, o+384, o+512, o+640, o+768, o+896)
+
+// func blamkaNEON(q *block)
+TEXT ·blamkaNEON(SB), NOSPLIT, $0-8
+	MOVD  q+0(FP), R0
+	MOVD  $·rot24<>(SB), R1
+	FMOVQ (R1), F18
+	MOVD  $·rot16<>(SB), R1
+	FMOVQ (R1), F19
+
+	ROW(0)
+	ROW(128)
+	ROW(256)
+	ROW(384)
+	ROW(512)
+	ROW(640)
+	ROW(768)
+	ROW(896)
+
+	COLUMN(0)
+	COLUMN(16)
+	COLUMN(32)
+	COLUMN(48)
+	COLUMN(64)
+	COLUMN(80)
+	COLUMN(96)
+	COLUMN(112)
+	RET
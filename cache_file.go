@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "io"
+import "os"
+import "fmt"
+import "bytes"
+import "unsafe"
+import "path/filepath"
+import "encoding/binary"
+import "golang.org/x/crypto/blake2b"
+
+const cacheMagic = "RandomXC"
+
+// a cache file holds the header, the argon2 blocks and then every superscalar program as
+//
+//	address reg  uint32
+//	count        uint32
+//	instructions count * 8 bytes: opcode, dst, src, mod, imm32
+//
+// the checksum covers blocks and programs
+const superscalarInstructionSize = 8
+
+// words of the argon2 blocks
+func blockWords(blocks []block) []uint64 {
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&blocks[0])), len(blocks)*len(blocks[0]))
+}
+
+func marshalPrograms(programs *[RANDOMX_PROGRAM_COUNT]*SuperScalarProgram) []byte {
+	var buf []byte
+	for _, p := range programs {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(p.AddressReg))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(p.Ins)))
+		for i := range p.Ins {
+			ins := &p.Ins[i]
+			buf = append(buf, ins.Opcode, byte(ins.Dst_Reg), byte(int8(ins.Src_Reg)), ins.Mod)
+			buf = binary.LittleEndian.AppendUint32(buf, ins.Imm32)
+		}
+	}
+	return buf
+}
+
+// rebuild programs written by marshalPrograms, only the fields used to execute and list them are restored
+func unmarshalPrograms(r io.Reader, h io.Writer) (programs [RANDOMX_PROGRAM_COUNT]*SuperScalarProgram, err error) {
+	r = io.TeeReader(r, h)
+	var head [8]byte
+	for i := range programs {
+		if _, err = io.ReadFull(r, head[:]); err != nil {
+			return programs, fmt.Errorf("%w: reading program %d: %s", ErrInvalidFile, i, err)
+		}
+		address_reg := binary.LittleEndian.Uint32(head[0:])
+		count := binary.LittleEndian.Uint32(head[4:])
+		if address_reg >= REGISTERSCOUNT || count > uint32(SuperscalarMaxSize) {
+			return programs, fmt.Errorf("%w: program %d is malformed", ErrInvalidFile, i)
+		}
+
+		buf := make([]byte, count*superscalarInstructionSize)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return programs, fmt.Errorf("%w: reading program %d: %s", ErrInvalidFile, i, err)
+		}
+
+		p := &SuperScalarProgram{Ins: make([]SuperScalarInstruction, count), AddressReg: int(address_reg)}
+		for j := range p.Ins {
+			b := buf[j*superscalarInstructionSize:]
+			ins := &p.Ins[j]
+			ins.Opcode = b[0]
+			ins.Dst_Reg = int(b[1])
+			ins.Src_Reg = int(int8(b[2]))
+			ins.Mod = b[3]
+			ins.Imm32 = binary.LittleEndian.Uint32(b[4:])
+
+			name, ok := Opcode_To_String[int(ins.Opcode)]
+			if !ok || ins.Dst_Reg >= REGISTERSCOUNT || ins.Src_Reg >= REGISTERSCOUNT || ins.Src_Reg < -1 {
+				return programs, fmt.Errorf("%w: program %d instruction %d is malformed", ErrInvalidFile, i, j)
+			}
+			ins.Name = name
+			if ins.Opcode == S_IMUL_RCP {
+				if ins.Imm32 == 0 {
+					return programs, fmt.Errorf("%w: program %d instruction %d is malformed", ErrInvalidFile, i, j)
+				}
+				ins.reciprocal = randomx_reciprocal(uint64(ins.Imm32))
+			}
+		}
+		programs[i] = p
+	}
+	return programs, nil
+}
+
+// write blocks and programs to w in the format read by Load, the cache must be initialized
+func (cache *Randomx_Cache) WriteTo(w io.Writer) (n int64, err error) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	if !cache.initialized() {
+		return 0, ErrCacheNotInitialized
+	}
+
+	programs := marshalPrograms(&cache.Programs)
+	words := blockWords(cache.Blocks)
+
+	h, _ := blake2b.New256(nil)
+	writeWords(h, words)
+	h.Write(programs)
+
+	header := fileHeader{
+		magic:     cacheMagic,
+		version:   fileVersion,
+		itemSize:  ArgonBlockSize,
+		params:    parametersFingerprint(),
+		keyHash:   cache.keyHash,
+		itemCount: RANDOMX_ARGON_MEMORY,
+	}
+	h.Sum(header.checksum[:0])
+
+	m, err := w.Write(header.marshal())
+	n += int64(m)
+	if err != nil {
+		return n, err
+	}
+	k, err := writeWords(w, words)
+	n += k
+	if err != nil {
+		return n, err
+	}
+	m, err = w.Write(programs)
+	return n + int64(m), err
+}
+
+// replace the contents of the cache with a file written by WriteTo for key
+// fails with ErrFileMismatch if the file was built for another key or parameter set and with ErrInvalidFile if it is corrupt
+// like Randomx_init_cache the blocks are read over those of the previous key, holding the cache meanwhile
+// a file for another key leaves the cache as it was, one which turns out corrupt leaves it uninitialized
+func (cache *Randomx_Cache) Load(r io.Reader, key []byte) (err error) {
+	var header fileHeader
+	if err := header.readFrom(r, cacheMagic); err != nil {
+		return err
+	}
+	if err := header.check(ArgonBlockSize, RANDOMX_ARGON_MEMORY, keyFingerprint(key)); err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	m := cache.target()
+	h, _ := blake2b.New256(nil)
+	words := m.words()
+	err = readWords(r, words)
+	var programs [RANDOMX_PROGRAM_COUNT]*SuperScalarProgram
+	if err == nil {
+		writeWords(h, words)
+		programs, err = unmarshalPrograms(r, h)
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), header.checksum[:]) {
+		err = fmt.Errorf("%w: checksum mismatch", ErrInvalidFile)
+	}
+	if err == nil {
+		cache.publish(m, &programs, key)
+	} else {
+		cache.rollback(m)
+	}
+	return err
+}
+
+// initialize the cache for key from dir, where a previous call saved it
+// a missing, stale or corrupt file is recomputed with Randomx_init_cache and saved again
+// saving is best effort, the cache is initialized whenever the returned error is nil
+// blocks of the previous key are reused in either case, the cache may be uninitialized after an error
+func (cache *Randomx_Cache) InitFromDir(dir string, key []byte) (loaded bool, err error) {
+	path := filepath.Join(dir, fmt.Sprintf("%x.cache", keyFingerprint(key)))
+
+	if f, err := os.Open(path); err == nil {
+		err = cache.Load(f, key)
+		f.Close()
+		if err == nil {
+			return true, nil
+		}
+	}
+
+	if err := cache.Randomx_init_cache(key); err != nil {
+		return false, err
+	}
+	cache.save(path)
+	return false, nil
+}
+
+// write the cache to a temporary file renamed to path once complete, so readers never see a partial file
+func (cache *Randomx_Cache) save(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := cache.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,459 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// randomx calculates, verifies and benchmarks RandomX hashes from the command line
+//
+//	randomx hash   -key <hex> -input <hex>
+//	randomx verify -key <hex> -input <hex> -expected <hex>
+//	randomx bench  -key <hex> -threads 4 -hashes 64 [-full [-dataset <file> | -shared <file>] | -item-cache <MiB> | -auto [-budget <MiB>]] [-large-pages] [-lock]
+//	randomx dump   -key <hex>
+//	randomx items  -key <hex> -start 0 -count 1048576 -out <file>
+//
+// -key-file and -input-file read raw bytes from a file instead, "-" reads stdin
+// -cache-dir keeps caches between runs, so the argon2 fill only runs once per key
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "flag"
+import "sync"
+import "time"
+import "bytes"
+import "errors"
+import "path/filepath"
+import "context"
+import "runtime"
+import "os/signal"
+import "sync/atomic"
+import "encoding/hex"
+import "encoding/binary"
+
+import "randomx"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: randomx <hash|verify|bench|dump|items> [flags]\n")
+	fmt.Fprintf(os.Stderr, "run randomx <command> -h for flags of a command\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "hash":
+		err = cmdHash(os.Args[1:], false)
+	case "verify":
+		err = cmdHash(os.Args[1:], true)
+	case "bench":
+		err = cmdBench(os.Args[2:])
+	case "dump":
+		err = cmdDump(os.Args[2:])
+	case "items":
+		err = cmdItems(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "randomx %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// a byte string given either as hex on the command line or as a file
+type byteSource struct {
+	hex  *string
+	file *string
+	name string
+}
+
+func newByteSource(fs *flag.FlagSet, name string) *byteSource {
+	return &byteSource{
+		hex:  fs.String(name, "", name+" as hex"),
+		file: fs.String(name+"-file", "", "read "+name+" from file, - for stdin"),
+		name: name,
+	}
+}
+
+func (b *byteSource) bytes() ([]byte, error) {
+	switch {
+	case *b.hex != "" && *b.file != "":
+		return nil, fmt.Errorf("-%s and -%s-file are mutually exclusive", b.name, b.name)
+	case *b.file == "-":
+		return io.ReadAll(os.Stdin)
+	case *b.file != "":
+		return os.ReadFile(*b.file)
+	default:
+		data, err := hex.DecodeString(*b.hex)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %s", b.name, err)
+		}
+		return data, nil
+	}
+}
+
+const cacheDirUsage = "load the cache from this directory, or compute and save it there when missing"
+
+// build a hasher for key, reporting how long cache initialization took
+// with a cache_dir the cache is loaded from there when it was saved before
+func newHasher(key []byte, flags randomx.Flags, trace bool, cache_dir string) (*randomx.Hasher, time.Duration, error) {
+	start := time.Now()
+
+	cache, err := randomx.Randomx_alloc_cache(flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	if trace {
+		cache.Tracer = randomx.NewWriterTracer(os.Stderr, randomx.TraceDebug)
+	}
+	if cache_dir == "" {
+		err = cache.Randomx_init_cache(key)
+	} else {
+		_, err = cache.InitFromDir(cache_dir, key)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	h, err := randomx.NewHasherFromCache(cache, flags)
+	return h, time.Since(start), err
+}
+
+// one line describing how memory was obtained, and why requested features are missing
+func allocationString(a randomx.Allocation) string {
+	s := fmt.Sprintf("%d MiB", a.Size>>20)
+	switch {
+	case a.LargePages:
+		s += " large pages"
+	case a.Transparent:
+		s += " transparent huge pages"
+	}
+	if a.Locked {
+		s += " locked"
+	}
+	if a.Fallback != "" {
+		s += " (" + a.Fallback + ")"
+	}
+	return s
+}
+
+// args[0] is the command name, hash or verify
+func cmdHash(args []string, verify bool) error {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	key := newByteSource(fs, "key")
+	input := newByteSource(fs, "input")
+	trace := fs.Bool("trace", false, "print cache init, programs and intermediate hashes to stderr")
+	cache_dir := fs.String("cache-dir", "", cacheDirUsage)
+	var expected *string
+	if verify {
+		expected = fs.String("expected", "", "expected hash as hex")
+	}
+	fs.Parse(args[1:])
+
+	k, err := key.bytes()
+	if err != nil {
+		return err
+	}
+	in, err := input.bytes()
+	if err != nil {
+		return err
+	}
+	var want []byte
+	if verify {
+		if want, err = hex.DecodeString(*expected); err != nil || len(want) != randomx.RANDOMX_HASH_SIZE {
+			return fmt.Errorf("-expected must be %d bytes of hex", randomx.RANDOMX_HASH_SIZE)
+		}
+	}
+
+	h, _, err := newHasher(k, randomx.GetFlags(), *trace, *cache_dir)
+	if err != nil {
+		return err
+	}
+	output_hash, err := h.Hash(in)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%x\n", output_hash)
+
+	if verify && !bytes.Equal(want, output_hash[:]) {
+		return fmt.Errorf("mismatch, expected %x", want)
+	}
+	return nil
+}
+
+func cmdBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	key := newByteSource(fs, "key")
+	threads := fs.Int("threads", runtime.NumCPU(), "number of hashing goroutines")
+	hashes := fs.Int("hashes", 64, "total number of hashes to calculate")
+	full := fs.Bool("full", false, "hash in full memory mode, the 2 GiB dataset is computed first on all threads")
+	dataset_file := fs.String("dataset", "", "with -full, load the dataset from file, or compute and save it there when missing")
+	shared := fs.String("shared", "", "with -full, share the dataset with other processes through this file, e.g. /dev/shm/randomx.dataset")
+	cache_dir := fs.String("cache-dir", "", cacheDirUsage)
+	item_cache := fs.Uint64("item-cache", 0, "in light mode, memoize dataset items using this many MiB")
+	large_pages := fs.Bool("large-pages", false, "back cache, dataset and scratchpads with huge pages where possible")
+	lock := fs.Bool("lock", false, "pin cache, dataset and scratchpads in RAM where possible")
+	auto := fs.Bool("auto", false, "choose full mode, light mode with item cache or light mode from the memory budget")
+	budget := fs.Uint64("budget", 0, "with -auto, memory budget in MiB, 0 for MemAvailable")
+	fs.Parse(args)
+
+	if *threads < 1 || *hashes < 1 {
+		return fmt.Errorf("-threads and -hashes must be positive")
+	}
+	k, err := key.bytes()
+	if err != nil {
+		return err
+	}
+
+	item_cache_size := *item_cache << 20
+	if *auto {
+		selection := randomx.SelectMode(*budget << 20)
+		fmt.Printf("%s\n", selection)
+		*full = selection.Mode == randomx.ModeFull
+		item_cache_size = selection.ItemCache
+	}
+
+	flags := randomx.GetFlags()
+	if *large_pages {
+		flags |= randomx.RANDOMX_FLAG_LARGE_PAGES
+	}
+	if *lock {
+		flags |= randomx.RANDOMX_FLAG_LOCK_MEMORY
+	}
+
+	h, init_time, err := newHasher(k, flags, false, *cache_dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cache init %s, %s\n", init_time, allocationString(h.Cache.Allocation()))
+
+	hash := func(input []byte, output []byte) error {
+		result, err := h.Hash(input)
+		copy(output, result[:])
+		return err
+	}
+	if *full {
+		pool, err := newFullPool(h.Cache, k, flags, *threads, *dataset_file, *shared)
+		if err != nil {
+			return err
+		}
+		hash = pool.CalculateHash
+	} else if item_cache_size > 0 {
+		h.Cache.Items = randomx.NewItemCache(item_cache_size)
+	}
+
+	var next int64 = -1
+	var first_err error
+	var once sync.Once
+	var wg sync.WaitGroup
+	start := time.Now()
+	for t := 0; t < *threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var nonce [8]byte
+			var output [randomx.RANDOMX_HASH_SIZE]byte
+			for {
+				n := atomic.AddInt64(&next, 1)
+				if n >= int64(*hashes) {
+					return
+				}
+				binary.LittleEndian.PutUint64(nonce[:], uint64(n))
+				if err := hash(nonce[:], output[:]); err != nil {
+					once.Do(func() { first_err = err })
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if first_err != nil {
+		return first_err
+	}
+	fmt.Printf("%d hashes on %d threads in %s, %.2f hashes/second\n", *hashes, *threads, elapsed, float64(*hashes)/elapsed.Seconds())
+	if h.Cache.Items != nil {
+		stats := h.Cache.Items.Stats()
+		fmt.Printf("item cache %d hits %d misses %d evictions %d items\n", stats.Hits, stats.Misses, stats.Evictions, stats.Items)
+	}
+	return nil
+}
+
+// load the dataset from path if it was saved for key, otherwise compute it from cache showing progress
+// interrupting stops the computation. a computed dataset is saved to path unless path is empty
+// with a shared path the dataset is computed there by the first process and mapped by the others
+// the pool VMs read the complete dataset only, cache is just the source to compute it from
+func newFullPool(cache *randomx.Randomx_Cache, key []byte, flags randomx.Flags, threads int, path, shared string) (*randomx.VMPool, error) {
+	flags |= randomx.RANDOMX_FLAG_FULL_MEM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	progress := func(done, total uint64) {
+		fmt.Fprintf(os.Stderr, "\rdataset init %5.1f%%", 100*float64(done)/float64(total))
+	}
+
+	if shared != "" {
+		start := time.Now()
+		dataset, err := randomx.ShareDataset(ctx, shared, cache, threads, progress)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("dataset shared through %s in %s\n", shared, time.Since(start))
+		return randomx.NewVMPool(flags, nil, dataset)
+	}
+
+	if path != "" {
+		dataset, err := randomx.LoadDataset(path, key)
+		if err == nil {
+			fmt.Printf("dataset loaded from %s\n", path)
+			return randomx.NewVMPool(flags, nil, dataset)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	dataset, err := randomx.Randomx_alloc_dataset(flags)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("dataset %s\n", allocationString(dataset.Allocation()))
+
+	start := time.Now()
+	err = dataset.InitContext(ctx, cache, threads, progress)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("dataset init %s\n", time.Since(start))
+
+	if path != "" {
+		if err := saveDataset(dataset, path); err != nil {
+			return nil, err
+		}
+		fmt.Printf("dataset saved to %s\n", path)
+	}
+	return randomx.NewVMPool(flags, nil, dataset)
+}
+
+// write to a temporary file first, so an interrupted save never leaves a truncated dataset at path
+func saveDataset(dataset *randomx.Randomx_Dataset, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := dataset.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func cmdDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	key := newByteSource(fs, "key")
+	cache_dir := fs.String("cache-dir", "", cacheDirUsage)
+	fs.Parse(args)
+
+	k, err := key.bytes()
+	if err != nil {
+		return err
+	}
+
+	h, _, err := newHasher(k, randomx.GetFlags(), false, *cache_dir)
+	if err != nil {
+		return err
+	}
+	for i, p := range h.Cache.Programs {
+		fmt.Printf("; superscalar program %d\n%s\n", i, p)
+	}
+	return nil
+}
+
+// write a range of dataset items in the reference layout, so ranges computed on several machines can be concatenated
+func cmdItems(args []string) error {
+	fs := flag.NewFlagSet("items", flag.ExitOnError)
+	key := newByteSource(fs, "key")
+	start := fs.Uint64("start", 0, "first item")
+	count := fs.Uint64("count", randomx.Randomx_dataset_item_count(), "number of items")
+	out := fs.String("out", "-", "output file, - for stdout")
+	cache_dir := fs.String("cache-dir", "", cacheDirUsage)
+	fs.Parse(args)
+
+	k, err := key.bytes()
+	if err != nil {
+		return err
+	}
+	h, _, err := newHasher(k, randomx.GetFlags(), false, *cache_dir)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		return writeItems(os.Stdout, h.Cache, *start, *count)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = writeItems(f, h.Cache, *start, *count)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// items are computed and written a batch at a time, so memory use does not depend on count
+func writeItems(w io.Writer, cache *randomx.Randomx_Cache, start, count uint64) error {
+	const batch = 16384
+	buf := make([]byte, batch*randomx.RANDOMX_DATASET_ITEM_SIZE)
+	for done := uint64(0); done < count; {
+		n := min(batch, count-done)
+		if err := cache.GetDatasetItems(start+done, n, buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n*randomx.RANDOMX_DATASET_ITEM_SIZE]); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
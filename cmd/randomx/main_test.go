@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import "os"
+import "bytes"
+import "testing"
+import "path/filepath"
+import "encoding/binary"
+
+import "randomx"
+
+func Test_CmdItems(t *testing.T) {
+	key := []byte("test key 000")
+	cache_dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "items")
+
+	// one item more than a batch, so the last one is written by a second batch
+	const count = 16385
+	args := []string{"-key", "74657374206b657920303030", "-count", "16385", "-out", path, "-cache-dir", cache_dir}
+	if err := cmdItems(args); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(data)) != count*randomx.RANDOMX_DATASET_ITEM_SIZE {
+		t.Fatalf("expected %d bytes, actual %d", count*randomx.RANDOMX_DATASET_ITEM_SIZE, len(data))
+	}
+	if actual := binary.LittleEndian.Uint64(data); actual != 0x680588a85ae222db {
+		t.Errorf("item 0: expected 680588a85ae222db, actual %x", actual)
+	}
+
+	h, _, err := newHasher(key, randomx.GetFlags(), false, cache_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	expected := make([]byte, randomx.RANDOMX_DATASET_ITEM_SIZE)
+	if err := h.Cache.GetDatasetItems(count-1, 1, expected); err != nil {
+		t.Fatal(err)
+	}
+	if actual := data[(count-1)*randomx.RANDOMX_DATASET_ITEM_SIZE:]; !bytes.Equal(actual, expected) {
+		t.Errorf("item %d: expected %x, actual %x", count-1, expected, actual)
+	}
+
+	args = []string{"-key", "74657374206b657920303030", "-count", "1", "-out", filepath.Join(path, "missing", "items"), "-cache-dir", cache_dir}
+	if err := cmdItems(args); err == nil {
+		t.Error("unwritable output: expected an error")
+	}
+}
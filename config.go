@@ -30,12 +30,13 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package randomx
 
 import "fmt"
+import "sync"
+import "context"
+import "time"
+import "runtime"
 import "encoding/binary"
 import "golang.org/x/crypto/blake2b"
 
-import _ "unsafe"
-import _ "golang.org/x/crypto/argon2"
-
 // see reference configuration.h
 //Cache size in KiB. Must be a power of 2.
 const RANDOMX_ARGON_MEMORY = 262144
@@ -88,9 +89,13 @@ const RANDOMX_JUMP_OFFSET = 8
 
 const DATASETEXTRAITEMS = RANDOMX_DATASET_EXTRA_SIZE / RANDOMX_DATASET_ITEM_SIZE
 
+// number of 64 byte items in a full dataset
+const RANDOMX_DATASET_ITEM_COUNT = (RANDOMX_DATASET_BASE_SIZE + RANDOMX_DATASET_EXTRA_SIZE) / RANDOMX_DATASET_ITEM_SIZE
+
 const ArgonBlockSize uint32 = 1024
 const SuperscalarMaxSize int = 3*RANDOMX_SUPERSCALAR_LATENCY + 2
 const RANDOMX_DATASET_ITEM_SIZE uint64 = 64
+const RANDOMX_HASH_SIZE = 32
 const CacheLineSize uint64 = RANDOMX_DATASET_ITEM_SIZE
 const ScratchpadSize uint32 = RANDOMX_SCRATCHPAD_L3
 
@@ -124,10 +129,6 @@ const staticExponentBits = 4
 const constExponentBits uint64 = 0x300
 const dynamicMantissaMask = (uint64(1) << (mantissaSize + dynamicExponentBits)) - 1
 
-const RANDOMX_FLAG_DEFAULT = 0
-const RANDOMX_FLAG_JIT = 1
-const RANDOMX_FLAG_LARGE_PAGES = 2
-
 func isZeroOrPowerOf2(x uint64) bool {
 	return (x & (x - 1)) == 0
 }
@@ -163,93 +164,230 @@ func (b *Blake2Generator) checkdata(bytesNeeded int) {
 func (b *Blake2Generator) GetByte() byte {
 	b.checkdata(1)
 	ret := b.data[b.dataindex]
-	fmt.Printf("returning byte %02x\n", ret)
 	b.dataindex++
 	return ret
 }
 func (b *Blake2Generator) GetUint32() uint32 {
 	b.checkdata(4)
 	ret := uint32(binary.LittleEndian.Uint32(b.data[b.dataindex:]))
-	fmt.Printf("returning int32 %08x %08x\n", ret, binary.LittleEndian.Uint32(b.data[b.dataindex:]))
 	b.dataindex += 4
-	fmt.Printf("returning int32 %08x\n", ret)
-
-	if ret == 0xc5dac17e {
-		// panic("exiting")
-	}
-
 	return ret
 }
 
+// a cache is read-only while hashing and may be shared by any number of VMs
+// mu is held for reading by every hash and for writing while the cache is (re)initialized
 type Randomx_Cache struct {
-	Blocks []block
+	Blocks []block // only valid while the cache is reachable and not closed
 
 	Programs [RANDOMX_PROGRAM_COUNT]*SuperScalarProgram
+
+	Flags Flags // flags the cache was allocated with
+
+	Tracer Tracer // receives diagnostics, may be nil. VMs created afterwards inherit it
+
+	// optional memo of items computed by light and hybrid VMs, set before hashing starts and never shared between caches
+	Items *ItemCache
+
+	keyHash [32]byte // fingerprint of the key, ties files derived from the cache to it
+	memory  *memory  // backs Blocks
+
+	mu sync.RWMutex
+}
+
+// allocate a cache, fails if flags request a cache feature which is not available
+// memory for the blocks is obtained when the cache is first initialized, reused for later keys and released by Close
+func Randomx_alloc_cache(flags Flags) (*Randomx_Cache, error) {
+	if err := checkFlags(flags, cacheFlags); err != nil {
+		return nil, err
+	}
+	return &Randomx_Cache{Flags: flags & cacheFlags}, nil
+}
+
+// CacheStage is the part of a cache initialization reported to CacheProgress
+type CacheStage int
+
+const (
+	CacheStageArgon2   CacheStage = iota // filling blocks, done counts slices, pass is (done-1)/4 and slice is (done-1)%4
+	CacheStagePrograms                   // generating superscalar programs, done counts programs
+)
+
+func (s CacheStage) String() string {
+	switch s {
+	case CacheStageArgon2:
+		return "argon2"
+	case CacheStagePrograms:
+		return "programs"
+	}
+	return fmt.Sprintf("CacheStage(%d)", int(s))
 }
 
-func Randomx_alloc_cache(flags uint64) *Randomx_Cache {
+// CacheProgress is called while a cache is initialized, after every argon2 slice and every superscalar program
+// calls are done in order on one goroutine, each stage ends with done == total
+type CacheProgress func(stage CacheStage, done, total uint64)
+
+// fills the cache from key and derives the superscalar programs from the same key
+// rekeying overwrites the blocks of the previous key in place, so memory use stays flat across keys
+// VMs using the cache wait until the new key is complete and then hash with it
+// on error the cache is left uninitialized, its blocks are kept for the next key
+func (cache *Randomx_Cache) Randomx_init_cache(key []byte) (err error) {
+	return cache.build(context.Background(), key, nil)
+}
 
-	return &Randomx_Cache{}
+// same as Randomx_init_cache, reporting progress when it is not nil, progress must not use the cache
+// cancelling ctx stops the work within one argon2 slice or superscalar program and returns ctx.Err() at once
+// a cancelled rekey leaves the cache uninitialized, the previous key is not restored
+func (cache *Randomx_Cache) InitContext(ctx context.Context, key []byte, progress CacheProgress) error {
+	return cache.build(ctx, key, progress)
 }
 
-func (cache *Randomx_Cache) Randomx_init_cache(key []byte) {
-	fmt.Printf("appending null byte is not necessary but only done for testing")
+// compute blocks and programs for key over the blocks of the current key, holding the cache meanwhile
+func (cache *Randomx_Cache) build(ctx context.Context, key []byte, progress CacheProgress) (err error) {
+	defer recoverError(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var argon2Progress func(done, total uint64)
+	if progress != nil {
+		argon2Progress = func(done, total uint64) { progress(CacheStageArgon2, done, total) }
+	}
+
+	start := time.Now()
 	kkey := append([]byte{}, key...)
 	//kkey = append(kkey,0)
 	//cache->initialize(cache, key, keySize);
-	cache.Blocks = buildBlocks(argon2d, kkey, []byte(RANDOMX_ARGON_SALT), []byte{}, []byte{}, RANDOMX_ARGON_ITERATIONS, RANDOMX_ARGON_MEMORY, RANDOMX_ARGON_LANES, 0)
 
-}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 
-// fetch a 64 byte block in uint64 form
-func (cache *Randomx_Cache) GetBlock(addr uint64, out []uint64) {
+	m := cache.target()
+	done := false
+	defer func() {
+		if !done {
+			cache.rollback(m)
+		}
+	}()
 
-	mask := CacheSize/CacheLineSize - 1
+	if err := cache.fill(ctx, m, kkey, argon2Progress); err != nil {
+		return err
+	}
 
-	addr = (addr & mask) * CacheLineSize
+	var programs [RANDOMX_PROGRAM_COUNT]*SuperScalarProgram
+	gen := Init_Blake2Generator(kkey, 0)
+	for i := range programs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		programs[i] = Build_SuperScalar_Program(gen) // build a superscalar program
+
+		if tracing(cache.Tracer, TraceProgramBuilt) {
+			cache.Tracer.Trace(&TraceEvent{Type: TraceProgramBuilt, Index: i, Program: programs[i]})
+		}
+		if progress != nil {
+			progress(CacheStagePrograms, uint64(i+1), RANDOMX_PROGRAM_COUNT)
+		}
+	}
 
-	block := addr / 1024
-	index_within_block := (addr % 1024) / 8
+	done = true
+	cache.publish(m, &programs, kkey)
 
-	copy(out, cache.Blocks[block][index_within_block:])
+	if tracing(cache.Tracer, TraceCacheInit) {
+		cache.Tracer.Trace(&TraceEvent{Type: TraceCacheInit, Duration: time.Since(start)})
+	}
+	return nil
 }
 
-// some constants for argon
-const (
-	argon2d = iota
-	argon2i
-	argon2id
-)
-
-type block [128]uint64
+// argon2 fill of the blocks in m from key
+func (cache *Randomx_Cache) fill(ctx context.Context, m *memory, key []byte, progress func(done, total uint64)) error {
+	return buildBlocks(ctx, m.blocks(), cache.Flags, progress, key, []byte(RANDOMX_ARGON_SALT), []byte{}, []byte{}, RANDOMX_ARGON_ITERATIONS, RANDOMX_ARGON_LANES, 0)
+}
 
-const syncPoints = 4
+// blocks a new key is written into, those of the current key if there are any, caller holds cache.mu
+func (cache *Randomx_Cache) target() *memory {
+	if cache.memory != nil {
+		return cache.memory
+	}
+	return allocMemory(CacheSize, cache.Flags)
+}
 
-//go:linkname argon2_initHash golang.org/x/crypto/argon2.initHash
-func argon2_initHash(password, salt, key, data []byte, time, memory, threads, keyLen uint32, mode int) [blake2b.Size + 8]byte
+// a rekey stopped after writing into m, the cache is left uninitialized keeping m for the next key, caller holds cache.mu
+func (cache *Randomx_Cache) rollback(m *memory) {
+	cache.clear()
+	cache.memory = m
+}
 
-//go:linkname argon2_initBlocks golang.org/x/crypto/argon2.initBlocks
-func argon2_initBlocks(h0 *[blake2b.Size + 8]byte, memory, threads uint32) []block
+// make blocks in m and programs computed from key current, caller holds cache.mu
+func (cache *Randomx_Cache) publish(m *memory, programs *[RANDOMX_PROGRAM_COUNT]*SuperScalarProgram, key []byte) {
+	if cache.memory != m {
+		cache.memory.free()
+	}
+	cache.memory = m
+	cache.Blocks = m.blocks()
+	cache.Programs = *programs
+	cache.keyHash = keyFingerprint(key)
+	if cache.Items != nil {
+		cache.Items.reset()
+	}
+}
 
-//go:linkname argon2_processBlocks golang.org/x/crypto/argon2.processBlocks
-func argon2_processBlocks(B []block, time, memory, threads uint32, mode int)
+// how the memory of the blocks was obtained, zero before the cache is initialized
+func (cache *Randomx_Cache) Allocation() Allocation {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 
-func buildBlocks(mode int, password, salt, secret, data []byte, time, memory uint32, threads uint8, keyLen uint32) []block {
-	if time < 1 {
-		panic("argon2: number of rounds too small")
+	if cache.memory == nil {
+		return Allocation{}
 	}
-	if threads < 1 {
-		panic("argon2: parallelism degree too low")
-	}
-	h0 := argon2_initHash(password, salt, secret, data, time, memory, uint32(threads), keyLen, mode)
+	return cache.memory.Allocation
+}
 
-	memory = memory / (syncPoints * uint32(threads)) * (syncPoints * uint32(threads))
-	if memory < 2*syncPoints*uint32(threads) {
-		memory = 2 * syncPoints * uint32(threads)
+// release the blocks and programs, the cache is uninitialized afterwards and may be initialized again
+// waits until no VM is hashing with the cache
+func (cache *Randomx_Cache) Close() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	err := cache.memory.free()
+	cache.clear()
+	return err
+}
+
+// same as Close, named after randomx_release_cache of the reference
+func (cache *Randomx_Cache) Randomx_release_cache() error {
+	return cache.Close()
+}
+
+// forget blocks, programs and key, caller holds cache.mu and has released or kept the memory
+func (cache *Randomx_Cache) clear() {
+	cache.memory = nil
+	cache.Blocks = nil
+	cache.Programs = [RANDOMX_PROGRAM_COUNT]*SuperScalarProgram{}
+	cache.keyHash = [32]byte{}
+	if cache.Items != nil {
+		cache.Items.reset()
 	}
-	B := argon2_initBlocks(&h0, memory, uint32(threads))
-	argon2_processBlocks(B, time, memory, uint32(threads), mode)
+}
+
+// identifies a key without storing it
+func keyFingerprint(key []byte) [32]byte {
+	return blake2b.Sum256(key)
+}
+
+// cache is usable only after blocks and programs were both generated
+func (cache *Randomx_Cache) initialized() bool {
+	return cache != nil && uint64(len(cache.Blocks)) == RANDOMX_ARGON_MEMORY && cache.Programs[RANDOMX_CACHE_ACCESSES-1] != nil
+}
+
+// fetch a 64 byte block in uint64 form
+func (cache *Randomx_Cache) GetBlock(addr uint64, out []uint64) {
 
-	return B
-	//return extractKey(B, memory, uint32(threads), keyLen)
+	mask := CacheSize/CacheLineSize - 1
+
+	addr = (addr & mask) * CacheLineSize
+
+	block := addr / 1024
+	index_within_block := (addr % 1024) / 8
+
+	copy(out, cache.Blocks[block][index_within_block:])
+	runtime.KeepAlive(cache)
 }
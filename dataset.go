@@ -0,0 +1,487 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "runtime"
+import "sync/atomic"
+import "encoding/binary"
+
+// flags which are looked at while allocating a dataset, others are ignored
+const datasetFlags = RANDOMX_FLAG_LARGE_PAGES | RANDOMX_FLAG_LOCK_MEMORY
+
+// Randomx_Dataset holds every item a VM may read, it is only used in full memory mode
+// where VMs copy their mix blocks from it instead of computing them from the cache
+// the dataset must not be initialized while VMs are hashing with it, except by InitContext for hybrid VMs
+type Randomx_Dataset struct {
+	Memory []uint64 // RANDOMX_DATASET_ITEM_COUNT items of 8 words each, only valid while the dataset is reachable and not closed
+	Flags  Flags
+	Tracer Tracer // receives diagnostics, may be nil
+
+	incomplete atomic.Bool // an InitContext call is running or did not finish, VMs refuse the dataset
+
+	// chunks computed by InitContext or loaded from a file, hybrid VMs compute items of other chunks from the cache
+	ready [datasetChunkCount]atomic.Uint32
+
+	keyHash  atomic.Pointer[[32]byte] // fingerprint of the key of the cache the items were computed from, read by hybrid VMs
+	checksum [32]byte                 // checksum of the items as recorded in the file the dataset was loaded from
+	memory   *memory                  // backs Memory, allocated or mapped from a file
+	shared   bool                     // Memory maps a file other processes read, it must not change
+
+	mu sync.Mutex // serializes key switches and readiness changes of concurrent initializations, guards checksum
+}
+
+// DatasetProgress is called while a dataset is initialized with the number of items done so far
+// calls are serialized and done only grows, after a successful initialization the last call has done == total
+type DatasetProgress func(done, total uint64)
+
+// items per readiness chunk, also the work done between two checks for cancellation and progress reports
+const datasetChunkItems = 16384
+const datasetChunkCount = (RANDOMX_DATASET_ITEM_COUNT + datasetChunkItems - 1) / datasetChunkItems
+
+// allocate memory for a full dataset, its items are filled by Randomx_init_dataset
+// the memory is released by Close, or by the garbage collector once the dataset is unreachable
+func Randomx_alloc_dataset(flags Flags) (*Randomx_Dataset, error) {
+	if err := checkFlags(flags, datasetFlags); err != nil {
+		return nil, err
+	}
+	m := allocMemory(RANDOMX_DATASET_ITEM_COUNT*RANDOMX_DATASET_ITEM_SIZE, flags)
+	return &Randomx_Dataset{Memory: m.words(), Flags: flags & datasetFlags, memory: m}, nil
+}
+
+// how the memory of the dataset was obtained, a dataset loaded from a file reports its mapping as ordinary pages
+func (dataset *Randomx_Dataset) Allocation() Allocation {
+	if dataset.memory == nil {
+		return Allocation{Size: uint64(len(dataset.Memory)) * 8}
+	}
+	return dataset.memory.Allocation
+}
+
+// number of items in a dataset, as randomx_dataset_item_count
+func Randomx_dataset_item_count() uint64 {
+	return RANDOMX_DATASET_ITEM_COUNT
+}
+
+// compute item_count items starting at start_item from an initialized cache
+// disjoint ranges may be initialized concurrently to spread the work over several goroutines
+// chunks the range covers entirely are ready afterwards, hybrid VMs compute items of other chunks from their cache
+// the cache is only held while a chunk is computed, rekeying it meanwhile fails with ErrCacheNotInitialized
+func (dataset *Randomx_Dataset) Randomx_init_dataset(cache *Randomx_Cache, start_item, item_count uint64) (err error) {
+	if start_item > RANDOMX_DATASET_ITEM_COUNT || item_count > RANDOMX_DATASET_ITEM_COUNT-start_item {
+		return fmt.Errorf("%w: %d items from %d", ErrInvalidDatasetRange, item_count, start_item)
+	}
+	if cache == nil {
+		return ErrCacheNotInitialized
+	}
+	if dataset.shared {
+		return ErrDatasetReadOnly
+	}
+
+	cache.mu.RLock()
+	initialized, keyHash := cache.initialized(), cache.keyHash
+	cache.mu.RUnlock()
+	if !initialized {
+		return ErrCacheNotInitialized
+	}
+	defer recoverError(&err)
+
+	start := time.Now()
+	end := start_item + item_count
+	dataset.rekey(keyHash, start_item, end)
+	for first := start_item; first < end; {
+		batch_end := min((first/datasetChunkItems+1)*datasetChunkItems, end)
+		if err := dataset.initChunk(cache, keyHash, first, batch_end); err != nil {
+			return err
+		}
+		dataset.markReady(keyHash, first, batch_end)
+		first = batch_end
+	}
+
+	if tracing(dataset.Tracer, TraceDatasetInit) {
+		dataset.Tracer.Trace(&TraceEvent{Type: TraceDatasetInit, Duration: time.Since(start), Index: int(start_item)})
+	}
+	return nil
+}
+
+// compute count items starting at start into dst, which must hold count*RANDOMX_DATASET_ITEM_SIZE bytes
+// every item is 8 little endian words, the layout of the reference dataset and of dataset files after their header
+// ranges may be computed by other processes or machines and assembled with SetDatasetItems
+func (cache *Randomx_Cache) GetDatasetItems(start, count uint64, dst []byte) (err error) {
+	if start > RANDOMX_DATASET_ITEM_COUNT || count > RANDOMX_DATASET_ITEM_COUNT-start {
+		return fmt.Errorf("%w: %d items from %d", ErrInvalidDatasetRange, count, start)
+	}
+	if uint64(len(dst)) < count*RANDOMX_DATASET_ITEM_SIZE {
+		return ErrOutputTooSmall
+	}
+	if err := cache.acquire(); err != nil {
+		return err
+	}
+	defer cache.release()
+	defer recoverError(&err)
+
+	var item [8]uint64
+	for i := uint64(0); i < count; i++ {
+		cache.InitDatasetItem(item[:], start+i)
+		out := dst[i*RANDOMX_DATASET_ITEM_SIZE:]
+		for j, w := range item {
+			binary.LittleEndian.PutUint64(out[j*8:], w)
+		}
+	}
+	return nil
+}
+
+// copy items computed by GetDatasetItems for key into the dataset, starting at item start
+// like Randomx_init_dataset, only chunks the items cover entirely are ready afterwards
+func (dataset *Randomx_Dataset) SetDatasetItems(key []byte, start uint64, src []byte) error {
+	count := uint64(len(src)) / RANDOMX_DATASET_ITEM_SIZE
+	if uint64(len(src))%RANDOMX_DATASET_ITEM_SIZE != 0 || start > RANDOMX_DATASET_ITEM_COUNT || count > RANDOMX_DATASET_ITEM_COUNT-start {
+		return fmt.Errorf("%w: %d bytes from item %d", ErrInvalidDatasetRange, len(src), start)
+	}
+	if uint64(len(dataset.Memory)) != RANDOMX_DATASET_ITEM_COUNT*8 {
+		return ErrDatasetNotAllocated
+	}
+	if dataset.shared {
+		return ErrDatasetReadOnly
+	}
+
+	keyHash := keyFingerprint(key)
+	dataset.rekey(keyHash, start, start+count)
+	words := dataset.Memory[start*8 : (start+count)*8]
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(src[i*8:])
+	}
+	dataset.markReady(keyHash, start, start+count)
+	return nil
+}
+
+// prepare items first up to end to be written for keyHash, chunks holding them are not ready until written
+// items of a previous key are no longer ready at all, only the first of concurrent callers for a new key drops them
+func (dataset *Randomx_Dataset) rekey(keyHash [32]byte, first, end uint64) {
+	dataset.mu.Lock()
+	defer dataset.mu.Unlock()
+
+	if dataset.key() != keyHash {
+		dataset.setReady(false)
+		dataset.setKey(keyHash)
+	}
+	dataset.checksum = [32]byte{} // items no longer match a loaded file
+	for chunk := first / datasetChunkItems; chunk*datasetChunkItems < end; chunk++ {
+		dataset.ready[chunk].Store(0)
+	}
+}
+
+// compute the whole dataset from cache, splitting the items over threads goroutines ( all cpus if threads < 1 )
+// progress may be nil, cancelling ctx stops all goroutines and returns ctx.Err()
+// a dataset whose initialization failed or was cancelled is refused by VMs until InitContext succeeds
+// hybrid VMs may hash while this runs, they read every chunk as soon as it is complete
+// the cache is only held while a chunk is computed, rekeying it meanwhile fails with ErrCacheNotInitialized
+func (dataset *Randomx_Dataset) InitContext(ctx context.Context, cache *Randomx_Cache, threads int, progress DatasetProgress) (err error) {
+	if threads < 1 {
+		threads = runtime.NumCPU()
+	}
+	if cache == nil {
+		return ErrCacheNotInitialized
+	}
+	if dataset.shared {
+		return ErrDatasetReadOnly
+	}
+
+	cache.mu.RLock()
+	initialized, keyHash := cache.initialized(), cache.keyHash
+	cache.mu.RUnlock()
+	if !initialized {
+		return ErrCacheNotInitialized
+	}
+
+	dataset.incomplete.Store(true)
+	dataset.mu.Lock()
+	dataset.setReady(false)
+	dataset.setKey(keyHash)
+	dataset.checksum = [32]byte{} // items no longer match a loaded file
+	dataset.mu.Unlock()
+
+	start := time.Now()
+	if err = dataset.initParallel(ctx, cache, keyHash, 0, RANDOMX_DATASET_ITEM_COUNT, threads, progress); err != nil {
+		return err
+	}
+
+	dataset.incomplete.Store(false)
+
+	if tracing(dataset.Tracer, TraceDatasetInit) {
+		dataset.Tracer.Trace(&TraceEvent{Type: TraceDatasetInit, Duration: time.Since(start)})
+	}
+	return nil
+}
+
+// compute items first up to end from cache while it holds the key of keyHash, split over threads goroutines
+func (dataset *Randomx_Dataset) initParallel(ctx context.Context, cache *Randomx_Cache, keyHash [32]byte, first, end uint64, threads int, progress DatasetProgress) (err error) {
+	ctx, cancel := context.WithCancel(ctx) // first failing goroutine stops the others
+	defer cancel()
+
+	var mu sync.Mutex // serializes progress calls
+	var done uint64
+	report := func(n uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		done += n
+		if progress != nil {
+			progress(done, end-first)
+		}
+	}
+
+	// threads get whole chunks, so every chunk is computed by one thread and can be marked ready
+	// only the first thread may start inside a chunk, when first does
+	base := first / datasetChunkItems * datasetChunkItems
+	chunks := (end - base + datasetChunkItems - 1) / datasetChunkItems
+	per_thread := (chunks + uint64(threads) - 1) / uint64(threads) * datasetChunkItems
+	errs := make(chan error, threads)
+	for t := uint64(0); t < uint64(threads); t++ {
+		thread_first := min(max(base+t*per_thread, first), end)
+		thread_end := min(base+(t+1)*per_thread, end)
+		go func() {
+			errs <- dataset.initItemsContext(ctx, cache, keyHash, thread_first, thread_end, report)
+		}()
+	}
+	for t := 0; t < threads; t++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
+
+// compute items first up to end a chunk at a time, checking ctx and reporting progress after every chunk
+// chunks computed completely are marked ready. the cache is only held while a chunk is computed,
+// so it can be rekeyed meanwhile, which fails the initialization instead of mixing items of two keys
+func (dataset *Randomx_Dataset) initItemsContext(ctx context.Context, cache *Randomx_Cache, keyHash [32]byte, first, end uint64, report func(n uint64)) (err error) {
+	defer recoverError(&err)
+
+	for first < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch_end := min((first/datasetChunkItems+1)*datasetChunkItems, end)
+		if err := dataset.initChunk(cache, keyHash, first, batch_end); err != nil {
+			return err
+		}
+		dataset.markReady(keyHash, first, batch_end)
+		report(batch_end - first)
+		first = batch_end
+	}
+	return nil
+}
+
+// compute items first up to end holding the cache, if it still has the key of keyHash
+func (dataset *Randomx_Dataset) initChunk(cache *Randomx_Cache, keyHash [32]byte, first, end uint64) error {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	if !cache.initialized() || cache.keyHash != keyHash {
+		return fmt.Errorf("%w: cache was rekeyed or closed", ErrCacheNotInitialized)
+	}
+	dataset.initItems(cache, first, end)
+	return nil
+}
+
+// fingerprint of the key the items were computed from, zero before any item was computed
+func (dataset *Randomx_Dataset) key() [32]byte {
+	if keyHash := dataset.keyHash.Load(); keyHash != nil {
+		return *keyHash
+	}
+	return [32]byte{}
+}
+
+// set by initializations before any chunk of the new key is marked ready
+func (dataset *Randomx_Dataset) setKey(keyHash [32]byte) {
+	dataset.keyHash.Store(&keyHash)
+}
+
+// mark every chunk ready or not ready
+func (dataset *Randomx_Dataset) setReady(ready bool) {
+	var v uint32
+	if ready {
+		v = 1
+	}
+	for i := range dataset.ready {
+		dataset.ready[i].Store(v)
+	}
+}
+
+// mark ready the chunks whose items all lie between first and end, the last chunk is shorter than the others
+// nothing is marked if the dataset was rekeyed away from keyHash while the items were computed
+func (dataset *Randomx_Dataset) markReady(keyHash [32]byte, first, end uint64) {
+	dataset.mu.Lock()
+	defer dataset.mu.Unlock()
+
+	if dataset.key() != keyHash {
+		return
+	}
+	for chunk := (first + datasetChunkItems - 1) / datasetChunkItems; chunk < datasetChunkCount; chunk++ {
+		if min((chunk+1)*datasetChunkItems, RANDOMX_DATASET_ITEM_COUNT) > end {
+			break
+		}
+		dataset.ready[chunk].Store(1)
+	}
+}
+
+// record the checksum of the items, as written to or read from a file
+func (dataset *Randomx_Dataset) setChecksum(sum [32]byte) {
+	dataset.mu.Lock()
+	defer dataset.mu.Unlock()
+
+	dataset.checksum = sum
+}
+
+// checksum recorded by the last file written or loaded, zero if items were computed since
+func (dataset *Randomx_Dataset) recordedChecksum() [32]byte {
+	dataset.mu.Lock()
+	defer dataset.mu.Unlock()
+
+	return dataset.checksum
+}
+
+// whether every chunk has been computed
+func (dataset *Randomx_Dataset) complete() bool {
+	for i := range dataset.ready {
+		if dataset.ready[i].Load() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the chunk holding an item has been computed
+func (dataset *Randomx_Dataset) itemReady(itemnumber uint64) bool {
+	return dataset.ready[itemnumber/datasetChunkItems].Load() != 0
+}
+
+// compute items first up to end, caller holds the cache
+func (dataset *Randomx_Dataset) initItems(cache *Randomx_Cache, first, end uint64) {
+	for itemnumber := first; itemnumber < end; itemnumber++ {
+		cache.InitDatasetItem(dataset.item(itemnumber), itemnumber)
+	}
+	runtime.KeepAlive(dataset)
+}
+
+// words of a single item
+func (dataset *Randomx_Dataset) item(itemnumber uint64) []uint64 {
+	return dataset.Memory[itemnumber*8 : itemnumber*8+8 : itemnumber*8+8]
+}
+
+// datasetSource provides the mix blocks read by a VM
+// the cache computes them in light mode, a dataset holds them precomputed in full memory mode
+// and a hybrid source combines both while the dataset is still being computed
+type datasetSource interface {
+	acquire() error // held while a hash is calculated, fails if no item can be provided
+	release()
+	readItem(out *[8]uint64, itemnumber uint64)
+}
+
+// cache cannot be rekeyed until release
+func (cache *Randomx_Cache) acquire() error {
+	cache.mu.RLock()
+	if !cache.initialized() {
+		cache.mu.RUnlock()
+		return ErrCacheNotInitialized
+	}
+	return nil
+}
+
+func (cache *Randomx_Cache) release() {
+	cache.mu.RUnlock()
+}
+
+func (cache *Randomx_Cache) readItem(out *[8]uint64, itemnumber uint64) {
+	if cache.Items == nil {
+		cache.InitDatasetItem(out[:], itemnumber)
+		return
+	}
+	if !cache.Items.get(itemnumber, out) {
+		cache.InitDatasetItem(out[:], itemnumber)
+		cache.Items.put(itemnumber, out)
+	}
+}
+
+func (dataset *Randomx_Dataset) acquire() error {
+	if uint64(len(dataset.Memory)) != RANDOMX_DATASET_ITEM_COUNT*8 {
+		return ErrDatasetNotAllocated
+	}
+	if dataset.incomplete.Load() || dataset.key() == [32]byte{} { // no item was ever computed
+		return ErrDatasetNotInitialized
+	}
+	return nil
+}
+
+func (dataset *Randomx_Dataset) release() {
+}
+
+func (dataset *Randomx_Dataset) readItem(out *[8]uint64, itemnumber uint64) {
+	copy(out[:], dataset.item(itemnumber))
+	runtime.KeepAlive(dataset)
+}
+
+// hybridSource reads the chunks of a dataset which are ready and computes other items from the cache
+// items are only read from the dataset while it holds the key of the cache, which may be rekeyed in place
+type hybridSource struct {
+	cache   *Randomx_Cache
+	dataset *Randomx_Dataset
+	keyHash [32]byte // of the cache while it is acquired
+}
+
+func (s *hybridSource) acquire() error {
+	if uint64(len(s.dataset.Memory)) != RANDOMX_DATASET_ITEM_COUNT*8 {
+		return ErrDatasetNotAllocated
+	}
+	if err := s.cache.acquire(); err != nil {
+		return err
+	}
+	s.keyHash = s.cache.keyHash
+	return nil
+}
+
+func (s *hybridSource) release() {
+	s.cache.release()
+}
+
+// the key is checked again after the copy, items of a dataset rekeyed meanwhile are computed from the cache
+func (s *hybridSource) readItem(out *[8]uint64, itemnumber uint64) {
+	if s.dataset.key() == s.keyHash && s.dataset.itemReady(itemnumber) {
+		copy(out[:], s.dataset.item(itemnumber))
+		runtime.KeepAlive(s.dataset)
+		if s.dataset.key() == s.keyHash {
+			return
+		}
+	}
+	s.cache.readItem(out, itemnumber)
+}
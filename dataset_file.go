@@ -0,0 +1,262 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "io"
+import "os"
+import "fmt"
+import "runtime"
+import "encoding/binary"
+import "golang.org/x/crypto/blake2b"
+
+// files derived from a key start with a header, all integers are little endian
+//
+//	magic       8 bytes
+//	version     uint32
+//	item size   uint32
+//	parameters  32 bytes, fingerprint of the parameters the items depend on
+//	key         32 bytes, fingerprint of the key the items were computed from
+//	item count  uint64
+//	checksum    32 bytes, Blake2b-256 of the items
+//
+// the header is padded to fileHeaderSize so that items start 4 KiB aligned, where pages are larger the mapping also covers the header
+const fileHeaderSize = 4096
+const fileVersion = 1
+
+const datasetMagic = "RandomXD"
+
+type fileHeader struct {
+	magic     string
+	version   uint32
+	itemSize  uint32
+	params    [32]byte
+	keyHash   [32]byte
+	itemCount uint64
+	checksum  [32]byte
+}
+
+func (h *fileHeader) marshal() []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf, h.magic)
+	binary.LittleEndian.PutUint32(buf[8:], h.version)
+	binary.LittleEndian.PutUint32(buf[12:], h.itemSize)
+	copy(buf[16:48], h.params[:])
+	copy(buf[48:80], h.keyHash[:])
+	binary.LittleEndian.PutUint64(buf[80:], h.itemCount)
+	copy(buf[88:120], h.checksum[:])
+	return buf
+}
+
+// read a header from r, it must carry magic and the current version
+func (h *fileHeader) readFrom(r io.Reader, magic string) error {
+	buf := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("%w: reading header: %s", ErrInvalidFile, err)
+	}
+	if string(buf[:8]) != magic {
+		return fmt.Errorf("%w: bad magic %q", ErrInvalidFile, buf[:8])
+	}
+
+	h.magic = magic
+	h.version = binary.LittleEndian.Uint32(buf[8:])
+	h.itemSize = binary.LittleEndian.Uint32(buf[12:])
+	copy(h.params[:], buf[16:48])
+	copy(h.keyHash[:], buf[48:80])
+	h.itemCount = binary.LittleEndian.Uint64(buf[80:])
+	copy(h.checksum[:], buf[88:120])
+
+	if h.version != fileVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidFile, h.version)
+	}
+	return nil
+}
+
+// verify the file was built by these parameters from key, with the expected number of items
+func (h *fileHeader) check(itemSize uint32, itemCount uint64, keyHash [32]byte) error {
+	if h.params != parametersFingerprint() || h.itemSize != itemSize || h.itemCount != itemCount {
+		return fmt.Errorf("%w: built with different parameters", ErrFileMismatch)
+	}
+	if h.keyHash != keyHash {
+		return fmt.Errorf("%w: built for a different key", ErrFileMismatch)
+	}
+	return nil
+}
+
+// fingerprint of every parameter the cache and the dataset depend on
+func parametersFingerprint() [32]byte {
+	var buf []byte
+	for _, v := range []uint64{RANDOMX_ARGON_MEMORY, RANDOMX_ARGON_ITERATIONS, RANDOMX_ARGON_LANES, RANDOMX_CACHE_ACCESSES,
+		RANDOMX_SUPERSCALAR_LATENCY, RANDOMX_DATASET_BASE_SIZE, RANDOMX_DATASET_EXTRA_SIZE, RANDOMX_DATASET_ITEM_SIZE} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	buf = append(buf, RANDOMX_ARGON_SALT...)
+	return blake2b.Sum256(buf)
+}
+
+// write words in little endian form, a chunk at a time
+func writeWords(w io.Writer, words []uint64) (n int64, err error) {
+	buf := make([]byte, 1<<20)
+	for len(words) > 0 {
+		chunk := words[:min(len(words), len(buf)/8)]
+		for i, v := range chunk {
+			binary.LittleEndian.PutUint64(buf[i*8:], v)
+		}
+		m, err := w.Write(buf[:len(chunk)*8])
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		words = words[len(chunk):]
+	}
+	return n, nil
+}
+
+// fill words with little endian words read from r
+func readWords(r io.Reader, words []uint64) error {
+	buf := make([]byte, 1<<20)
+	for len(words) > 0 {
+		chunk := words[:min(len(words), len(buf)/8)]
+		if _, err := io.ReadFull(r, buf[:len(chunk)*8]); err != nil {
+			return fmt.Errorf("%w: reading items: %s", ErrInvalidFile, err)
+		}
+		for i := range chunk {
+			chunk[i] = binary.LittleEndian.Uint64(buf[i*8:])
+		}
+		words = words[len(chunk):]
+	}
+	return nil
+}
+
+// Blake2b-256 of words in little endian form
+func checksumWords(words []uint64) (sum [32]byte) {
+	h, _ := blake2b.New256(nil)
+	writeWords(h, words)
+	h.Sum(sum[:0])
+	return
+}
+
+// write the dataset to w in the format read by LoadDataset, the dataset must be completely initialized
+// every chunk must be ready, a dataset initialized in ranges is refused unless the ranges covered whole chunks
+func (dataset *Randomx_Dataset) WriteTo(w io.Writer) (n int64, err error) {
+	if err := dataset.acquire(); err != nil {
+		return 0, err
+	}
+	if !dataset.complete() {
+		return 0, fmt.Errorf("%w: some items were not computed", ErrDatasetNotInitialized)
+	}
+
+	sum := checksumWords(dataset.Memory)
+	dataset.setChecksum(sum)
+	header := fileHeader{
+		magic:     datasetMagic,
+		version:   fileVersion,
+		itemSize:  uint32(RANDOMX_DATASET_ITEM_SIZE),
+		params:    parametersFingerprint(),
+		keyHash:   dataset.key(),
+		itemCount: RANDOMX_DATASET_ITEM_COUNT,
+		checksum:  sum,
+	}
+
+	m, err := w.Write(header.marshal())
+	n += int64(m)
+	if err != nil {
+		return n, err
+	}
+	k, err := writeWords(w, dataset.Memory)
+	runtime.KeepAlive(dataset)
+	return n + k, err
+}
+
+// open a dataset written by WriteTo, fails with ErrFileMismatch if it was built for another key or parameter set
+// items are mapped where possible, so they are only read from disk when a VM touches them
+// the checksum is not verified here as that reads the whole file, see VerifyChecksum
+func LoadDataset(path string, key []byte) (*Randomx_Dataset, error) {
+	f, header, err := openDatasetFile(path, keyFingerprint(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words, unmap, err := mapWords(f, fileHeaderSize, RANDOMX_DATASET_ITEM_COUNT*8)
+	if err != nil {
+		return nil, err
+	}
+	dataset := &Randomx_Dataset{Memory: words, checksum: header.checksum, memory: mappedMemory(words, unmap)}
+	dataset.setKey(header.keyHash)
+	dataset.setReady(true)
+	return dataset, nil
+}
+
+// size of a dataset file written by WriteTo
+const datasetFileSize = fileHeaderSize + RANDOMX_DATASET_ITEM_COUNT*RANDOMX_DATASET_ITEM_SIZE
+
+// open a dataset file and check its header and size against the parameters and keyHash
+func openDatasetFile(path string, keyHash [32]byte) (*os.File, *fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var header fileHeader
+	err = header.readFrom(f, datasetMagic)
+	if err == nil {
+		err = header.check(uint32(RANDOMX_DATASET_ITEM_SIZE), RANDOMX_DATASET_ITEM_COUNT, keyHash)
+	}
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil && fi.Size() != int64(datasetFileSize) {
+			err = fmt.Errorf("%w: size %d, expected %d", ErrInvalidFile, fi.Size(), datasetFileSize)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &header, nil
+}
+
+// compare the items with the checksum recorded when the dataset was written or loaded
+func (dataset *Randomx_Dataset) VerifyChecksum() error {
+	sum := dataset.recordedChecksum()
+	if sum == [32]byte{} {
+		return fmt.Errorf("%w: no checksum recorded", ErrInvalidFile)
+	}
+	if checksumWords(dataset.Memory) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidFile)
+	}
+	return nil
+}
+
+// release the memory of the dataset, it cannot be used afterwards
+// no VM may be hashing with the dataset, as it would read memory returned to the system
+func (dataset *Randomx_Dataset) Close() error {
+	dataset.Memory = nil
+	return dataset.memory.free()
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "errors"
+import "fmt"
+
+var ErrUnsupportedFlags = errors.New("randomx: unsupported flags")
+var ErrInvalidArgon2Params = errors.New("randomx: invalid argon2 parameters")
+var ErrCacheNotInitialized = errors.New("randomx: cache is not initialized")
+var ErrDatasetNotAllocated = errors.New("randomx: dataset is required in full memory mode")
+var ErrDatasetNotInitialized = errors.New("randomx: dataset initialization did not complete")
+var ErrInvalidDatasetRange = errors.New("randomx: dataset item range out of bounds")
+var ErrDatasetReadOnly = errors.New("randomx: shared dataset cannot be initialized")
+var ErrInvalidFile = errors.New("randomx: invalid or corrupt file")
+var ErrFileMismatch = errors.New("randomx: file does not match key or parameters")
+var ErrOutputTooSmall = errors.New("randomx: output buffer too small")
+var ErrHashNotStarted = errors.New("randomx: CalculateHashFirst was not called")
+var ErrInvalidProgram = errors.New("randomx: invalid superscalar program")
+var ErrInvalidInstruction = errors.New("randomx: invalid VM instruction")
+var ErrInternal = errors.New("randomx: internal error")
+
+// hot paths cannot return errors, they panic with invalidState instead and recoverError turns it back into an error
+type invalidState struct {
+	err error
+}
+
+func raise(sentinel error, format string, args ...interface{}) {
+	panic(invalidState{fmt.Errorf("%w: %s", sentinel, fmt.Sprintf(format, args...))})
+}
+
+// deferred at every public entry point, so a corrupted state never crashes the process
+// any other panic is a programmer error and is reported as ErrInternal
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		if s, ok := r.(invalidState); ok {
+			*err = s.err
+		} else {
+			*err = fmt.Errorf("%w: %v", ErrInternal, r)
+		}
+	}
+}
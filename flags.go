@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "fmt"
+import "strings"
+
+// Flags select implementation features, values are same as reference randomx.h
+type Flags uint64
+
+const (
+	RANDOMX_FLAG_DEFAULT      Flags = 0
+	RANDOMX_FLAG_LARGE_PAGES  Flags = 1
+	RANDOMX_FLAG_HARD_AES     Flags = 2
+	RANDOMX_FLAG_FULL_MEM     Flags = 4
+	RANDOMX_FLAG_JIT          Flags = 8
+	RANDOMX_FLAG_SECURE       Flags = 16
+	RANDOMX_FLAG_ARGON2_SSSE3 Flags = 32
+	RANDOMX_FLAG_ARGON2_AVX2  Flags = 64
+	RANDOMX_FLAG_ARGON2       Flags = RANDOMX_FLAG_ARGON2_SSSE3 | RANDOMX_FLAG_ARGON2_AVX2
+
+	// not in randomx.h, pins caches, datasets and scratchpads in RAM so they are never swapped out
+	RANDOMX_FLAG_LOCK_MEMORY Flags = 1 << 16
+)
+
+// flags which are looked at while allocating a cache, others are ignored
+const cacheFlags = RANDOMX_FLAG_LARGE_PAGES | RANDOMX_FLAG_JIT | RANDOMX_FLAG_ARGON2 | RANDOMX_FLAG_LOCK_MEMORY
+
+// flags which are looked at while creating a VM, others are ignored
+const vmFlags = RANDOMX_FLAG_LARGE_PAGES | RANDOMX_FLAG_HARD_AES | RANDOMX_FLAG_FULL_MEM | RANDOMX_FLAG_JIT | RANDOMX_FLAG_SECURE | RANDOMX_FLAG_LOCK_MEMORY
+
+// flags implemented by this package, the interpreter never writes executable memory so SECURE is always honored
+// LARGE_PAGES and LOCK_MEMORY are requests, memory is still obtained when the system refuses them, see Allocation
+var supportedFlags = RANDOMX_FLAG_LARGE_PAGES | RANDOMX_FLAG_FULL_MEM | RANDOMX_FLAG_SECURE | RANDOMX_FLAG_LOCK_MEMORY
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{RANDOMX_FLAG_LARGE_PAGES, "LARGE_PAGES"},
+	{RANDOMX_FLAG_HARD_AES, "HARD_AES"},
+	{RANDOMX_FLAG_FULL_MEM, "FULL_MEM"},
+	{RANDOMX_FLAG_JIT, "JIT"},
+	{RANDOMX_FLAG_SECURE, "SECURE"},
+	{RANDOMX_FLAG_ARGON2_SSSE3, "ARGON2_SSSE3"},
+	{RANDOMX_FLAG_ARGON2_AVX2, "ARGON2_AVX2"},
+	{RANDOMX_FLAG_LOCK_MEMORY, "LOCK_MEMORY"},
+}
+
+func (f Flags) String() string {
+	if f == RANDOMX_FLAG_DEFAULT {
+		return "DEFAULT"
+	}
+	var names []string
+	for _, n := range flagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint64(f)))
+	}
+	return strings.Join(names, "|")
+}
+
+// returns recommended flags for the running machine, all of them are supported by this package
+// the ARGON2 flags are set when the CPU can run the matching assembly, see blamka_amd64.go
+func GetFlags() Flags {
+	return supportedFlags & RANDOMX_FLAG_ARGON2
+}
+
+// verify that every flag relevant to the caller is implemented
+func checkFlags(requested, relevant Flags) error {
+	if unsupported := requested & relevant &^ supportedFlags; unsupported != 0 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedFlags, unsupported)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "math"
+import "math/big"
+
+// go has no control over the fpu rounding mode, so every operation is computed
+// rounded to nearest and the exact error of that result decides whether it has
+// to move one ulp to honour the directed rounding modes used by CFROUND
+// this keeps the floating point path free of any allocation
+
+// below this magnitude the error of a product, quotient or root may underflow and lose its sign
+// it is then computed on operands scaled by errorScale, which keeps it in the normal range
+const errorUnderflow = 0x1p-900
+const errorScale = 0x1p256
+
+// fadd returns a+b rounded according to mode
+func fadd(a, b float64, mode big.RoundingMode) float64 {
+	s := a + b
+	if mode == big.ToNearestEven {
+		return s
+	}
+	if math.IsInf(s, 0) && !math.IsInf(a, 0) && !math.IsInf(b, 0) {
+		return roundOverflow(s, mode)
+	}
+	// an exact zero sum is -0 when rounding down, unless both operands are +0
+	if s == 0 && mode == big.ToNegativeInf && (math.Signbit(a) || math.Signbit(b)) {
+		return math.Copysign(0, -1)
+	}
+	// TwoSum, s + e == a + b exactly
+	bb := s - a
+	e := (a - (s - bb)) + (b - bb)
+	return roundDirected(s, e, mode)
+}
+
+// fsub returns a-b rounded according to mode
+func fsub(a, b float64, mode big.RoundingMode) float64 {
+	return fadd(a, -b, mode)
+}
+
+// fmul returns a*b rounded according to mode
+func fmul(a, b float64, mode big.RoundingMode) float64 {
+	p := a * b
+	if mode == big.ToNearestEven {
+		return p
+	}
+	if math.IsInf(p, 0) && !math.IsInf(a, 0) && !math.IsInf(b, 0) {
+		return roundOverflow(p, mode)
+	}
+	e := math.FMA(a, b, -p)
+	if math.Abs(p) < errorUnderflow {
+		// the smaller operand is scaled, so the other one cannot overflow
+		if math.Abs(a) > math.Abs(b) {
+			a, b = b, a
+		}
+		e = math.FMA(a*errorScale, b, -p*errorScale)
+		if p == 0 && a != 0 && b != 0 {
+			// the whole product underflowed, so the error is the product itself
+			e = math.Copysign(1, a) * math.Copysign(1, b)
+		}
+	}
+	return roundDirected(p, e, mode)
+}
+
+// fdiv returns a/b rounded according to mode
+func fdiv(a, b float64, mode big.RoundingMode) float64 {
+	q := a / b
+	if mode == big.ToNearestEven {
+		return q
+	}
+	if math.IsInf(q, 0) && !math.IsInf(a, 0) && b != 0 {
+		return roundOverflow(q, mode)
+	}
+	// the sign of a - q*b relative to b tells on which side of q the quotient lies
+	e := math.FMA(-q, b, a)
+	if math.Abs(a) < errorUnderflow || math.Abs(q) < errorUnderflow {
+		// one of a and q is tiny, which keeps the other far from overflowing once scaled
+		e = math.FMA(-q*errorScale, b, a*errorScale)
+	}
+	if b < 0 {
+		e = -e
+	}
+	return roundDirected(q, e, mode)
+}
+
+// fsqrt returns sqrt(a) rounded according to mode
+func fsqrt(a float64, mode big.RoundingMode) float64 {
+	s := math.Sqrt(a)
+	if mode == big.ToNearestEven {
+		return s
+	}
+	e := math.FMA(-s, s, a)
+	if a < errorUnderflow {
+		e = math.FMA(-s*0x1p128, s*0x1p128, a*errorScale) // s is scaled by the root of errorScale
+	}
+	return roundDirected(s, e, mode)
+}
+
+// roundDirected moves the round to nearest result r one ulp when the sign of the error e says the exact result was on the wrong side of r
+func roundDirected(r, e float64, mode big.RoundingMode) float64 {
+	switch {
+	case e == 0 || math.IsNaN(e):
+		return r
+	case mode == big.ToNegativeInf && e < 0:
+		return math.Nextafter(r, math.Inf(-1))
+	case mode == big.ToPositiveInf && e > 0:
+		return math.Nextafter(r, math.Inf(1))
+	case mode == big.ToZero && (r > 0) == (e < 0):
+		return math.Nextafter(r, 0)
+	}
+	return r
+}
+
+// roundOverflow returns the largest finite value instead of infinity for modes which round towards it
+func roundOverflow(r float64, mode big.RoundingMode) float64 {
+	switch {
+	case mode == big.ToZero,
+		mode == big.ToNegativeInf && r > 0,
+		mode == big.ToPositiveInf && r < 0:
+		return math.Copysign(math.MaxFloat64, r)
+	}
+	return r
+}
@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "sync"
+
+// number of independently locked parts of an item cache, a power of 2
+const itemCacheShards = 64
+
+// approximate memory used by one cached item, including its index entry
+const itemCacheEntrySize = RANDOMX_DATASET_ITEM_SIZE + 48
+
+// ItemCache memoizes dataset items computed in light mode, least recently used items are evicted first
+// it is attached to a single Randomx_Cache through its Items field and emptied whenever that cache is rekeyed
+// an ItemCache is safe for concurrent use
+type ItemCache struct {
+	shards [itemCacheShards]itemCacheShard
+}
+
+// ItemCacheStats are counted since the item cache was created
+type ItemCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Items     uint64 // items currently held
+}
+
+// every shard is a fixed array of slots linked in LRU order, so lookups and inserts do not allocate
+type itemCacheShard struct {
+	mu         sync.Mutex
+	index      map[uint64]int32 // item number to slot
+	slots      []itemCacheSlot
+	used       int32 // slots filled so far
+	head, tail int32 // most and least recently used slot, -1 if empty
+
+	hits, misses, evictions uint64
+}
+
+type itemCacheSlot struct {
+	item       uint64
+	prev, next int32
+	words      [8]uint64
+}
+
+// create an item cache using about budget bytes, at least one item per shard is kept
+func NewItemCache(budget uint64) *ItemCache {
+	per_shard := max(1, budget/itemCacheEntrySize/itemCacheShards)
+
+	c := &ItemCache{}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.index = make(map[uint64]int32, per_shard)
+		s.slots = make([]itemCacheSlot, per_shard)
+		s.head, s.tail = -1, -1
+	}
+	return c
+}
+
+func (c *ItemCache) shard(itemnumber uint64) *itemCacheShard {
+	return &c.shards[itemnumber&(itemCacheShards-1)]
+}
+
+// copy a cached item into out, false if it is not cached
+func (c *ItemCache) get(itemnumber uint64, out *[8]uint64) bool {
+	s := c.shard(itemnumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, ok := s.index[itemnumber]
+	if !ok {
+		s.misses++
+		return false
+	}
+	s.hits++
+	s.unlink(slot)
+	s.pushFront(slot)
+	*out = s.slots[slot].words
+	return true
+}
+
+// remember an item, evicting the least recently used one of its shard when full
+func (c *ItemCache) put(itemnumber uint64, words *[8]uint64) {
+	s := c.shard(itemnumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, ok := s.index[itemnumber]
+	switch {
+	case ok: // another VM computed it meanwhile
+		s.unlink(slot)
+	case int(s.used) < len(s.slots):
+		slot = s.used
+		s.used++
+	default:
+		slot = s.tail
+		s.unlink(slot)
+		delete(s.index, s.slots[slot].item)
+		s.evictions++
+	}
+
+	s.slots[slot].item = itemnumber
+	s.slots[slot].words = *words
+	s.index[itemnumber] = slot
+	s.pushFront(slot)
+}
+
+// drop every item, statistics are kept
+func (c *ItemCache) reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		clear(s.index)
+		s.used = 0
+		s.head, s.tail = -1, -1
+		s.mu.Unlock()
+	}
+}
+
+// counters summed over all shards
+func (c *ItemCache) Stats() (stats ItemCacheStats) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Evictions += s.evictions
+		stats.Items += uint64(len(s.index))
+		s.mu.Unlock()
+	}
+	return
+}
+
+func (s *itemCacheShard) unlink(slot int32) {
+	prev, next := s.slots[slot].prev, s.slots[slot].next
+	if prev >= 0 {
+		s.slots[prev].next = next
+	} else {
+		s.head = next
+	}
+	if next >= 0 {
+		s.slots[next].prev = prev
+	} else {
+		s.tail = prev
+	}
+}
+
+func (s *itemCacheShard) pushFront(slot int32) {
+	s.slots[slot].prev = -1
+	s.slots[slot].next = s.head
+	if s.head >= 0 {
+		s.slots[s.head].prev = slot
+	} else {
+		s.tail = slot
+	}
+	s.head = slot
+}
@@ -0,0 +1,85 @@
+//go:build unix
+
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "os"
+import "errors"
+import "unsafe"
+import "syscall"
+import "encoding/binary"
+
+var nativeLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// map count little endian words of f starting at offset, which needs no alignment
+// pages are private, so writes never reach the file. big endian machines, or systems refusing the mapping, read the words instead
+func mapWords(f *os.File, offset int64, count uint64) ([]uint64, func() error, error) {
+	if nativeLittleEndian {
+		if data, unmap, err := mapRange(f, offset, int(count*8), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE); err == nil {
+			return unsafe.Slice((*uint64)(unsafe.Pointer(&data[0])), count), unmap, nil
+		}
+	}
+
+	if _, err := f.Seek(offset, 0); err != nil {
+		return nil, nil, err
+	}
+	words := make([]uint64, count)
+	err := readWords(f, words)
+	return words, nil, err
+}
+
+// map count words of f starting at offset so that every process mapping the file sees the same memory
+// only writable mappings may be written, big endian machines cannot share the little endian file layout
+func mapSharedWords(f *os.File, offset int64, count uint64, writable bool) ([]uint64, func() error, error) {
+	if !nativeLittleEndian {
+		return nil, nil, errors.ErrUnsupported
+	}
+
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	data, unmap, err := mapRange(f, offset, int(count*8), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&data[0])), count), unmap, nil
+}
+
+// map length bytes of f at offset, the mapping starts on the page holding offset as pages may be larger than the file header
+func mapRange(f *os.File, offset int64, length int, prot, flags int) ([]byte, func() error, error) {
+	delta := offset % int64(os.Getpagesize())
+	data, err := syscall.Mmap(int(f.Fd()), offset-delta, length+int(delta), prot, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data[delta:], func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "io"
+import "os"
+import "fmt"
+import "bufio"
+import "strconv"
+import "strings"
+import "runtime"
+
+// Mode tells where the VMs of a Hasher get dataset items from, hashes are identical in every mode
+type Mode int
+
+const (
+	ModeLight     Mode = iota // every item is computed from the cache
+	ModeLightMemo             // items are computed from the cache and memoized in an ItemCache
+	ModeFull                  // items are read from a dataset computed up front
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeLight:
+		return "light"
+	case ModeLightMemo:
+		return "light with item cache"
+	case ModeFull:
+		return "full"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// ModeSelection is the mode chosen for a memory budget and the reason for it
+type ModeSelection struct {
+	Mode      Mode
+	Budget    uint64 // bytes the choice was made for
+	ItemCache uint64 // bytes given to the item cache in ModeLightMemo
+	Reason    string
+}
+
+func (s ModeSelection) String() string {
+	return fmt.Sprintf("%s mode, %s", s.Mode, s.Reason)
+}
+
+// an item cache smaller than this is hit too rarely to be worth its memory
+const minItemCacheSize = 64 << 20
+
+// choose the mode for a memory budget in bytes, 0 uses MemAvailable from /proc/meminfo
+// full mode needs the cache, the dataset and a scratchpad per cpu, light mode only the cache and scratchpads
+// whatever light mode leaves of the budget is given to an item cache
+// when the available memory cannot be determined light mode is chosen
+func SelectMode(budget uint64) ModeSelection {
+	if budget == 0 {
+		available, err := memAvailable()
+		if err != nil {
+			return ModeSelection{Mode: ModeLight, Reason: fmt.Sprintf("available memory unknown: %s", err)}
+		}
+		budget = available
+	}
+
+	scratchpads := uint64(runtime.GOMAXPROCS(0)) * uint64(ScratchpadSize)
+	light := CacheSize + scratchpads
+	full := light + RANDOMX_DATASET_ITEM_COUNT*RANDOMX_DATASET_ITEM_SIZE
+
+	s := ModeSelection{Budget: budget}
+	switch {
+	case budget >= full:
+		s.Mode = ModeFull
+		s.Reason = fmt.Sprintf("budget %d MiB covers cache, dataset and scratchpads (%d MiB)", budget>>20, full>>20)
+	case budget >= light+minItemCacheSize:
+		s.Mode = ModeLightMemo
+		s.ItemCache = budget - light
+		s.Reason = fmt.Sprintf("budget %d MiB is below the %d MiB full mode needs, %d MiB left for the item cache", budget>>20, full>>20, s.ItemCache>>20)
+	default:
+		s.Mode = ModeLight
+		s.Reason = fmt.Sprintf("budget %d MiB leaves less than %d MiB for an item cache after cache and scratchpads (%d MiB)", budget>>20, minItemCacheSize>>20, light>>20)
+	}
+	return s
+}
+
+// allocate and fill a cache from key, then prepare VMs in the mode SelectMode picks for budget
+// RANDOMX_FLAG_FULL_MEM in flags is ignored, it is set when full mode is chosen
+func NewHasherForBudget(key []byte, flags Flags, budget uint64) (*Hasher, ModeSelection, error) {
+	s := SelectMode(budget)
+
+	flags &^= RANDOMX_FLAG_FULL_MEM
+	if s.Mode == ModeFull {
+		flags |= RANDOMX_FLAG_FULL_MEM
+	}
+
+	var items *ItemCache
+	if s.Mode == ModeLightMemo {
+		items = NewItemCache(s.ItemCache)
+	}
+	h, err := newHasher(key, flags, items)
+	return h, s, err
+}
+
+// MemAvailable of linux, in bytes
+func memAvailable() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseMemAvailable(f)
+}
+
+// find the line "MemAvailable:   16303572 kB"
+func parseMemAvailable(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("MemAvailable: %w", err)
+		}
+		return kb << 10, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
@@ -27,68 +27,52 @@ OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
 USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 */
 
-//+build ignore
+package randomx
 
-package main
+import "sync"
 
-import "randomx"
-import "fmt"
-
-func main() {
-	c := randomx.Randomx_alloc_cache(0)
-
-	key := []byte("RandomX example key\x00")
-	myinput := []byte("RandomX example input\x00")
-
-	c.Randomx_init_cache(key)
+// VMPool hands out VMs which share one read-only cache or dataset, it is safe for concurrent use
+// every VM is used by a single goroutine between Get and Put
+type VMPool struct {
+	cache   *Randomx_Cache
+	dataset *Randomx_Dataset
+	flags   Flags
+	pool    sync.Pool
+}
 
-	nonce := uint32(0) //uint32(len(key))
-	gen := randomx.Init_Blake2Generator(key, nonce)
-	for i := 0; i < 8; i++ {
-		c.Programs[i] = randomx.Build_SuperScalar_Program(gen) // build a superscalar program
+// create a pool of VMs working on cache, or on dataset with RANDOMX_FLAG_FULL_MEM
+// arguments are validated here once, as by Randomx_create_vm
+func NewVMPool(flags Flags, cache *Randomx_Cache, dataset *Randomx_Dataset) (*VMPool, error) {
+	vm, err := Randomx_create_vm(flags, cache, dataset)
+	if err != nil {
+		return nil, err
 	}
 
-	vm := c.VM_Initialize()
-
-	_ = fmt.Sprintf("t")
-
-	var output_hash [32]byte
-	vm.CalculateHash(myinput, output_hash[:])
-
-	fmt.Printf("final output hash %x\n", output_hash)
-
-	vm.CalculateHash(myinput, output_hash[:])
-
-	fmt.Printf("final output hash %x\n", output_hash)
-
-	/*
-	   fmt.Printf("cache blocks %d block size %d %+v\n", len(c.Blocks), len(c.Blocks[0]), c.Blocks[0])
-
-	   register_value := uint64(0x70c13c)
-	   mask := randomx.CacheSize / randomx.CacheLineSize - 1;
-
-	   address :=  (register_value&mask)*   randomx.CacheLineSize
-
-
-	   var block [8]uint64
-
-	   c.GetBlock(address,block[:])
-
-	   for i := range block{
-	   	fmt.Printf("%d %16x\n", i, block[i])
-	   }
-
-	   //block := address / 1024
+	p := &VMPool{cache: cache, dataset: dataset, flags: flags}
+	p.pool.Put(vm)
+	return p, nil
+}
 
-	   //index_within_block := (address % 1024) / 8
+// take a VM for exclusive use, it must be returned with Put once done
+func (p *VMPool) Get() (*VM, error) {
+	if vm, ok := p.pool.Get().(*VM); ok {
+		return vm, nil
+	}
+	return Randomx_create_vm(p.flags, p.cache, p.dataset)
+}
 
-	   //fmt.Printf("mask %x address %x  block %d index_within_block %d  data %16x\n",mask, address, block, index_within_block,c.Blocks[block][index_within_block])
+// return a VM obtained from Get, it must not be used afterwards
+func (p *VMPool) Put(vm *VM) {
+	p.pool.Put(vm)
+}
 
-	   /*
-	   for i := range c.Blocks[block]{
-	   	fmt.Printf("%3d %16x\n", i,c.Blocks[block][i])
-	   }
-	*/
-	//c.InitDatasetItem(nil,0x70c13c)
+// calculate hash of input into output using any free VM
+func (p *VMPool) CalculateHash(input []byte, output []byte) error {
+	vm, err := p.Get()
+	if err != nil {
+		return err
+	}
+	defer p.Put(vm)
 
+	return vm.CalculateHash(input, output)
 }
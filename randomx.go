@@ -28,3 +28,112 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 */
 
 package randomx
+
+import "context"
+import "golang.org/x/crypto/blake2b"
+
+// Hasher owns an initialized cache and a pool of VMs, so callers only need a key and their inputs
+// a Hasher is safe for concurrent use
+type Hasher struct {
+	Cache   *Randomx_Cache
+	Dataset *Randomx_Dataset // only built with RANDOMX_FLAG_FULL_MEM
+	pool    *VMPool
+
+	ownCache bool // cache was allocated by NewHasher, so Close releases it
+}
+
+// allocate and fill a cache from key ( including superscalar programs ) and prepare a VM
+// flags are applied to both cache and VM, see GetFlags for recommended flags
+func NewHasher(key []byte, flags Flags) (*Hasher, error) {
+	return newHasher(key, flags, nil)
+}
+
+// hasher owning a new cache for key, items memoizes dataset items in light mode when not nil
+func newHasher(key []byte, flags Flags, items *ItemCache) (*Hasher, error) {
+	cache, err := Randomx_alloc_cache(flags)
+	if err != nil {
+		return nil, err
+	}
+	cache.Items = items
+	if err = cache.Randomx_init_cache(key); err != nil {
+		cache.Close()
+		return nil, err
+	}
+	h, err := NewHasherFromCache(cache, flags)
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	h.ownCache = true
+	return h, nil
+}
+
+// wrap an already initialized cache, the cache may be shared with other hashers
+// with RANDOMX_FLAG_FULL_MEM the whole dataset is computed from cache first, using all cpus
+func NewHasherFromCache(cache *Randomx_Cache, flags Flags) (*Hasher, error) {
+	var dataset *Randomx_Dataset
+	if flags&RANDOMX_FLAG_FULL_MEM != 0 {
+		var err error
+		if dataset, err = Randomx_alloc_dataset(flags); err != nil {
+			return nil, err
+		}
+		if err = dataset.InitContext(context.Background(), cache, 0, nil); err != nil {
+			dataset.Close()
+			return nil, err
+		}
+	}
+
+	// the dataset is complete, so its VMs never need items from cache
+	vm_cache := cache
+	if dataset != nil {
+		vm_cache = nil
+	}
+	pool, err := NewVMPool(flags, vm_cache, dataset)
+	if err != nil {
+		if dataset != nil {
+			dataset.Close()
+		}
+		return nil, err
+	}
+	return &Hasher{Cache: cache, Dataset: dataset, pool: pool}, nil
+}
+
+// release the dataset, and the cache when it was allocated by NewHasher
+// no hash may be in progress, the hasher cannot be used afterwards
+func (h *Hasher) Close() error {
+	var err error
+	if h.Dataset != nil {
+		err = h.Dataset.Close()
+	}
+	if h.ownCache {
+		if e := h.Cache.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// calculate RandomX hash of input
+func (h *Hasher) Hash(input []byte) (output [RANDOMX_HASH_SIZE]byte, err error) {
+	err = h.pool.CalculateHash(input, output[:])
+	return
+}
+
+// commitment is Blake2b-256 of input followed by its hash, as randomx_calculate_commitment
+// it binds a hash to its input so a claimed result can be checked cheaply before recalculating it
+func CalculateCommitment(input []byte, hash_in [RANDOMX_HASH_SIZE]byte) (commitment [RANDOMX_HASH_SIZE]byte) {
+	hash256, _ := blake2b.New256(nil)
+	hash256.Write(input)
+	hash256.Write(hash_in[:])
+	hash256.Sum(commitment[:0])
+	return
+}
+
+// calculate RandomX hash of input together with its commitment
+func (h *Hasher) HashWithCommitment(input []byte) (output, commitment [RANDOMX_HASH_SIZE]byte, err error) {
+	if output, err = h.Hash(input); err != nil {
+		return
+	}
+	commitment = CalculateCommitment(input, output)
+	return
+}
@@ -30,7 +30,21 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package randomx
 
 import "fmt"
+import "bytes"
+import "os"
+import "math"
+import "math/big"
+import "math/rand"
+import "sync"
+import "errors"
+import "context"
+import "time"
+import "path/filepath"
+import "runtime"
+import "strings"
 import "testing"
+import "encoding/hex"
+import "encoding/binary"
 
 func Test_Randomx(t *testing.T) {
 
@@ -40,27 +54,32 @@ func Test_Randomx(t *testing.T) {
 		expected string // expected result
 	}{
 		{[]byte("RandomX example key\x00"), []byte("RandomX example input\x00"), "8a48e5f9db45ab79d9080574c4d81954fe6ac63842214aff73c244b26330b7c9"},
-		{[]byte("test key 000"), []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"}, // test a
-		//  {[]byte("test key 000"), []byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969" }, // test b
+		{[]byte("test key 000"), []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},                                                    // test a
+		{[]byte("test key 000"), []byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969"},                                        // test b
 		{[]byte("test key 000"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"}, // test c
 		{[]byte("test key 001"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"}, // test d
 	}
 
-	c := Randomx_alloc_cache(0)
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, tt := range Tests {
 
-		c.Randomx_init_cache(tt.key)
+		if err := c.Randomx_init_cache(tt.key); err != nil {
+			t.Fatal(err)
+		}
 
-		nonce := uint32(0) //uint32(len(key))
-		gen := Init_Blake2Generator(tt.key, nonce)
-		for i := 0; i < 8; i++ {
-			c.Programs[i] = Build_SuperScalar_Program(gen) // build a superscalar program
+		vm, err := c.VM_Initialize()
+		if err != nil {
+			t.Fatal(err)
 		}
-		vm := c.VM_Initialize()
 
 		var output_hash [32]byte
-		vm.CalculateHash(tt.input, output_hash[:])
+		if err := vm.CalculateHash(tt.input, output_hash[:]); err != nil {
+			t.Fatal(err)
+		}
 
 		actual := fmt.Sprintf("%x", output_hash)
 		if actual != tt.expected {
@@ -69,3 +88,1431 @@ func Test_Randomx(t *testing.T) {
 	}
 
 }
+
+func Test_Hasher(t *testing.T) {
+	h, err := NewHasher([]byte("test key 000"), GetFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output_hash, commitment, err := h.HashWithCommitment([]byte("This is a test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := fmt.Sprintf("%x", output_hash)
+	if expected := "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"; actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+	actual = fmt.Sprintf("%x", commitment)
+	if expected := "d53ccf348b75291b7be76f0a7ac8208bbced734b912f6fca60539ab6f86be919"; actual != expected {
+		t.Errorf("commitment: expected %s, actual %s", expected, actual)
+	}
+}
+
+// reference implementation commitment test vectors
+func Test_Commitment(t *testing.T) {
+	var Tests = []struct {
+		input    []byte // input
+		hash     string // randomx hash of input
+		expected string // expected commitment
+	}{
+		{[]byte("RandomX example input\x00"), "8a48e5f9db45ab79d9080574c4d81954fe6ac63842214aff73c244b26330b7c9", "6baae8b4f4fc7ae4265e269bb8d9936d80efe0095df2b80bcb772f9542301005"},
+		{[]byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f", "d53ccf348b75291b7be76f0a7ac8208bbced734b912f6fca60539ab6f86be919"},                                                    // test a
+		{[]byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969", "26bb9091b9e946a8d3b18f419537c45d041cfd2c063f168c93414134d5d53189"},                                        // test b
+		{[]byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8", "874aa4ad19f0ad2709e4d5d617d2460ddd20059b2be039e29f1ee878df8c9f14"}, // test c
+		{[]byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc", "560830c699484d194cd899c86579e7cc364a8b5068a520af4a86265d07d1f96f"}, // test d
+	}
+
+	for _, tt := range Tests {
+		var hash_in [RANDOMX_HASH_SIZE]byte
+		if _, err := hex.Decode(hash_in[:], []byte(tt.hash)); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := fmt.Sprintf("%x", CalculateCommitment(tt.input, hash_in)); actual != tt.expected {
+			t.Errorf("%s: expected %s, actual %s", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+// many goroutines hash through one Hasher, run with -race
+func Test_Hasher_Parallel(t *testing.T) {
+	var Tests = []struct {
+		input    []byte // input
+		expected string // expected result
+	}{
+		{[]byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},                                                    // test a
+		{[]byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969"},                                        // test b
+		{[]byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"}, // test c
+	}
+
+	h, err := NewHasher([]byte("test key 000"), GetFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// more goroutines than cpus, released together so that they contend for the pool of VMs
+	goroutines := runtime.GOMAXPROCS(0) * 4
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			tt := Tests[g%len(Tests)]
+			output_hash, err := h.Hash(tt.input)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if actual := fmt.Sprintf("%x", output_hash); actual != tt.expected {
+				t.Errorf("goroutine %d: expected %s, actual %s", g, tt.expected, actual)
+			}
+		}(g)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func Test_Flags(t *testing.T) {
+	if _, err := Randomx_alloc_cache(RANDOMX_FLAG_JIT); !errors.Is(err, ErrUnsupportedFlags) {
+		t.Errorf("JIT cache: expected ErrUnsupportedFlags, actual %v", err)
+	}
+	if _, err := Randomx_alloc_cache(RANDOMX_FLAG_FULL_MEM); err != nil {
+		t.Errorf("FULL_MEM is not a cache flag and must be ignored, actual %v", err)
+	}
+	if _, err := Randomx_create_vm(RANDOMX_FLAG_JIT, &Randomx_Cache{}, nil); !errors.Is(err, ErrUnsupportedFlags) {
+		t.Errorf("JIT vm: expected ErrUnsupportedFlags, actual %v", err)
+	}
+	if s := (RANDOMX_FLAG_JIT | RANDOMX_FLAG_ARGON2).String(); s != "JIT|ARGON2_SSSE3|ARGON2_AVX2" {
+		t.Errorf("unexpected flag names %s", s)
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	if _, err := Randomx_create_vm(RANDOMX_FLAG_SECURE, &Randomx_Cache{}, nil); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("uninitialized cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+
+	cache := &Randomx_Cache{}
+	vm := &VM{Cache: cache, source: cache}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHash(nil, output_hash[:16]); !errors.Is(err, ErrOutputTooSmall) {
+		t.Errorf("short output: expected ErrOutputTooSmall, actual %v", err)
+	}
+	if err := vm.CalculateHash(nil, output_hash[:]); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("uninitialized cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+
+	if err := buildBlocks(context.Background(), make([]block, 8), RANDOMX_FLAG_DEFAULT, nil, nil, nil, nil, nil, 0, 1, 0); !errors.Is(err, ErrInvalidArgon2Params) {
+		t.Errorf("zero rounds: expected ErrInvalidArgon2Params, actual %v", err)
+	}
+
+	err := func() (err error) {
+		defer recoverError(&err)
+		p := SuperScalarProgram{Ins: []SuperScalarInstruction{{Opcode: 99}}}
+		p.executeSuperscalar_nocache(make([]uint64, 8))
+		return nil
+	}()
+	if !errors.Is(err, ErrInvalidProgram) {
+		t.Errorf("bad opcode: expected ErrInvalidProgram, actual %v", err)
+	}
+}
+
+type recordingTracer struct {
+	events []TraceEvent
+}
+
+func (r *recordingTracer) Level() TraceLevel    { return TraceDebug }
+func (r *recordingTracer) Trace(ev *TraceEvent) { r.events = append(r.events, *ev) }
+
+func Test_Tracer(t *testing.T) {
+	tracer := &recordingTracer{}
+
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Tracer = tracer
+	if err := c.Randomx_init_cache([]byte("test key 000")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[TraceEventType]int{}
+	for _, ev := range tracer.events {
+		counts[ev.Type]++
+	}
+	if counts[TraceProgramBuilt] != RANDOMX_CACHE_ACCESSES || counts[TraceCacheInit] != 1 || counts[TraceChainHash] != RANDOMX_PROGRAM_COUNT-1 || counts[TraceFinalHash] != 1 {
+		t.Fatalf("unexpected events %v", counts)
+	}
+	if last := tracer.events[len(tracer.events)-1]; fmt.Sprintf("%x", last.Hash) != fmt.Sprintf("%x", output_hash) {
+		t.Errorf("final hash event %x does not match output %x", last.Hash, output_hash)
+	}
+}
+
+// pipelined hashes must match the hashes calculated one by one
+func Test_CalculateHashPipelined(t *testing.T) {
+	var Tests = []struct {
+		input    []byte // input
+		expected string // expected result
+	}{
+		{[]byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},                                                    // test a
+		{[]byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"}, // test c
+	}
+
+	c := testCache(t)
+	vm, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHashLast(output_hash[:]); !errors.Is(err, ErrHashNotStarted) {
+		t.Fatalf("expected ErrHashNotStarted, actual %v", err)
+	}
+
+	if err := vm.CalculateHashFirst(Tests[0].input); err != nil {
+		t.Fatal(err)
+	}
+	for i := range Tests {
+		if i+1 < len(Tests) {
+			err = vm.CalculateHashNext(Tests[i+1].input, output_hash[:])
+		} else {
+			err = vm.CalculateHashLast(output_hash[:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprintf("%x", output_hash); actual != Tests[i].expected {
+			t.Errorf("hash %d: expected %s, actual %s", i, Tests[i].expected, actual)
+		}
+	}
+}
+
+// CalculateHash reuses the state owned by the VM and must not allocate
+func Test_CalculateHash_Allocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping allocation check in short mode")
+	}
+
+	c := testCache(t)
+	vm, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("This is a test")
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	allocs := testing.AllocsPerRun(2, func() {
+		if err := vm.CalculateHash(input, output_hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocs per hash, actual %v", allocs)
+	}
+}
+
+func Test_DirectedRounding(t *testing.T) {
+	ulp := math.Ldexp(1, -52)
+	tiny := math.Ldexp(1, -60)
+	up := 1 + ulp
+	down := math.Nextafter(1, 0)
+
+	var Tests = []struct {
+		name     string
+		actual   float64
+		expected float64
+	}{
+		{"add nearest", fadd(1, tiny, big.ToNearestEven), 1},
+		{"add up", fadd(1, tiny, big.ToPositiveInf), up},
+		{"add down", fadd(1, -tiny, big.ToNegativeInf), down},
+		{"sub zero", fsub(-1, tiny, big.ToZero), -1},
+		{"mul up", fmul(up, up, big.ToPositiveInf), 1 + 3*ulp},
+		{"mul down", fmul(up, up, big.ToNegativeInf), 1 + 2*ulp},
+		{"div down", fdiv(1, 3, big.ToNegativeInf), 1.0 / 3},
+		{"div up", fdiv(1, 3, big.ToPositiveInf), math.Nextafter(1.0/3, 1)},
+		{"div negative zero", fdiv(1, -3, big.ToZero), -1.0 / 3},
+		{"sqrt up", fsqrt(2, big.ToPositiveInf), math.Sqrt2},
+		{"sqrt down", fsqrt(2, big.ToNegativeInf), math.Nextafter(math.Sqrt2, 0)},
+		{"overflow down", fmul(math.MaxFloat64, 2, big.ToNegativeInf), math.MaxFloat64},
+		{"overflow up", fmul(math.MaxFloat64, 2, big.ToPositiveInf), math.Inf(1)},
+		{"infinity zero", fmul(math.Inf(1), 2, big.ToZero), math.Inf(1)},
+		{"infinity sum zero", fadd(math.Inf(-1), 1, big.ToZero), math.Inf(-1)},
+		{"division by zero", fdiv(1, 0, big.ToZero), math.Inf(1)},
+		{"cancel down", fsub(1, 1, big.ToNegativeInf), math.Copysign(0, -1)},
+		{"cancel up", fsub(1, 1, big.ToPositiveInf), 0},
+		{"zeros down", fadd(0, 0, big.ToNegativeInf), 0},
+		{"underflow up", fmul(0x1p-600, 0x1p-600, big.ToPositiveInf), math.SmallestNonzeroFloat64},
+		{"underflow zero", fmul(-0x1p-600, 0x1p-600, big.ToZero), math.Copysign(0, -1)},
+		{"underflow div down", fdiv(-0x1p-1000, 0x1p100, big.ToNegativeInf), -math.SmallestNonzeroFloat64},
+	}
+
+	for _, tt := range Tests {
+		if math.Float64bits(tt.actual) != math.Float64bits(tt.expected) {
+			t.Errorf("%s: expected %v, actual %v", tt.name, tt.expected, tt.actual)
+		}
+	}
+}
+
+// every rounding mode matches math/big on random operands, subnormals, and products and quotients which overflow or underflow
+func Test_DirectedRoundingBigFloat(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	operand := func() float64 {
+		sign := float64(1 - 2*rng.Intn(2))
+		switch rng.Intn(4) {
+		case 0: // any exponent
+			for {
+				if f := math.Float64frombits(rng.Uint64()); !math.IsInf(f, 0) && !math.IsNaN(f) {
+					return f
+				}
+			}
+		case 1: // subnormal
+			return sign * math.Float64frombits(rng.Uint64()&(1<<52-1))
+		case 2: // close to 1, sums cancel
+			return sign * math.Ldexp(1+rng.Float64(), rng.Intn(21)-10)
+		default: // products underflow
+			return sign * math.Ldexp(1+rng.Float64(), rng.Intn(80)-580)
+		}
+	}
+	// sums and products of doubles are exact at this precision, quotients and roots never lie so close to a float64 that rounding twice differs
+	exact := func() *big.Float {
+		return new(big.Float).SetPrec(2200)
+	}
+	modes := []big.RoundingMode{big.ToNearestEven, big.ToZero, big.ToNegativeInf, big.ToPositiveInf}
+
+	for i := 0; i < 10000 && !t.Failed(); i++ {
+		a, b := operand(), operand()
+		x, y := big.NewFloat(a), big.NewFloat(b)
+
+		var Tests = []struct {
+			name  string
+			op    func(mode big.RoundingMode) float64
+			exact *big.Float
+		}{
+			{"add", func(mode big.RoundingMode) float64 { return fadd(a, b, mode) }, exact().Add(x, y)},
+			{"sub", func(mode big.RoundingMode) float64 { return fsub(a, b, mode) }, exact().Sub(x, y)},
+			{"mul", func(mode big.RoundingMode) float64 { return fmul(a, b, mode) }, exact().Mul(x, y)},
+			{"sqrt", func(mode big.RoundingMode) float64 { return fsqrt(math.Abs(a), mode) }, exact().Sqrt(new(big.Float).Abs(x))},
+		}
+		if b != 0 {
+			Tests = append(Tests, struct {
+				name  string
+				op    func(mode big.RoundingMode) float64
+				exact *big.Float
+			}{"div", func(mode big.RoundingMode) float64 { return fdiv(a, b, mode) }, exact().Quo(x, y)})
+		}
+
+		for _, tt := range Tests {
+			// the sign of exact zero sums is checked in Test_DirectedRounding, math/big does not follow IEEE 754 there
+			if tt.exact.Sign() == 0 && (tt.name == "add" || tt.name == "sub") {
+				continue
+			}
+			for _, mode := range modes {
+				if expected, actual := roundFloat64(tt.exact, mode), tt.op(mode); math.Float64bits(actual) != math.Float64bits(expected) {
+					t.Errorf("%s %x %x %s: expected %x, actual %x", tt.name, a, b, mode, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+// round x to a float64 by mode as IEEE 754 does, including subnormal results and overflow
+func roundFloat64(x *big.Float, mode big.RoundingMode) float64 {
+	if mode == big.ToNearestEven || x.Sign() == 0 {
+		f, _ := x.Float64()
+		return f
+	}
+	sign := float64(x.Sign())
+
+	if x.MantExp(nil) > -1022 { // at least the smallest normal
+		r := new(big.Float).SetPrec(53).SetMode(mode).Set(x)
+		if r.MantExp(nil) > 1024 {
+			if mode == big.ToZero || (mode == big.ToNegativeInf) != (sign < 0) {
+				return sign * math.MaxFloat64
+			}
+			return math.Inf(int(sign))
+		}
+		f, _ := r.Float64()
+		return f
+	}
+
+	// subnormals are multiples of 2^-1074, so x is rounded to a whole number of them
+	n, acc := new(big.Float).SetMantExp(x, 1074).Int(nil)
+	if acc != big.Exact {
+		switch {
+		case mode == big.ToPositiveInf && sign > 0:
+			n.Add(n, big.NewInt(1))
+		case mode == big.ToNegativeInf && sign < 0:
+			n.Sub(n, big.NewInt(1))
+		}
+	}
+	return math.Copysign(math.Ldexp(float64(n.Int64()), -1074), sign)
+}
+
+func Benchmark_CalculateHash(b *testing.B) {
+	vm, err := testCache(b).VM_Initialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := []byte("This is a test")
+	var output_hash [RANDOMX_HASH_SIZE]byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := vm.CalculateHash(input, output_hash[:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// DEFAULT and every ARGON2 flag the CPU supports
+func argon2Flags() []Flags {
+	flags := []Flags{RANDOMX_FLAG_DEFAULT}
+	for _, f := range []Flags{RANDOMX_FLAG_ARGON2_SSSE3, RANDOMX_FLAG_ARGON2_AVX2} {
+		if supportedFlags&f != 0 {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// filling 16 MiB with each implementation of the compression function, DEFAULT is the portable one
+// on arm64 the NEON permutation is used whatever the flags
+func Benchmark_Argon2(b *testing.B) {
+	B := make([]block, 16384)
+	for _, flags := range argon2Flags() {
+		b.Run(flags.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(B)) * int64(ArgonBlockSize))
+			for i := 0; i < b.N; i++ {
+				if err := buildBlocks(context.Background(), B, flags, nil, []byte("test key 000"), []byte(RANDOMX_ARGON_SALT), nil, nil, 1, 1, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// the cache for key "test key 000", initialized once for the tests which only read it
+// tests which rekey, trace or close their cache allocate their own
+var sharedCache struct {
+	once  sync.Once
+	cache *Randomx_Cache
+	err   error
+}
+
+func testCache(tb testing.TB) *Randomx_Cache {
+	sharedCache.once.Do(func() {
+		sharedCache.cache, sharedCache.err = Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+		if sharedCache.err == nil {
+			sharedCache.err = sharedCache.cache.Randomx_init_cache([]byte("test key 000"))
+		}
+	})
+	if sharedCache.err != nil {
+		tb.Fatal(sharedCache.err)
+	}
+	return sharedCache.cache
+}
+
+// first word of some dataset items for key "test key 000", from reference implementation
+var datasetItemTests = []struct {
+	item     uint64 // item number
+	expected uint64 // first word of item
+}{
+	{0, 0x680588a85ae222db},
+	{10000000, 0x7943a1f6186ffb72},
+	{20000000, 0x9035244d718095e1},
+	{30000000, 0x145a5091f7853099},
+}
+
+// records the items read by a light mode VM
+type recordingSource struct {
+	*Randomx_Cache
+	items []uint64
+}
+
+func (r *recordingSource) readItem(out *[8]uint64, itemnumber uint64) {
+	r.items = append(r.items, itemnumber)
+	r.Randomx_Cache.readItem(out, itemnumber)
+}
+
+func Test_Dataset(t *testing.T) {
+	c := testCache(t)
+	dataset, err := Randomx_alloc_dataset(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range datasetItemTests {
+		if err := dataset.Randomx_init_dataset(c, tt.item, 1); err != nil {
+			t.Fatal(err)
+		}
+		if actual := dataset.item(tt.item)[0]; actual != tt.expected {
+			t.Errorf("item %d: expected %x, actual %x", tt.item, tt.expected, actual)
+		}
+	}
+
+	// both ends of the dataset must match the items computed by a light VM
+	for _, start := range []uint64{0, Randomx_dataset_item_count() - 16} {
+		if err := dataset.Randomx_init_dataset(c, start, 16); err != nil {
+			t.Fatal(err)
+		}
+		var expected [8]uint64
+		for itemnumber := start; itemnumber < start+16; itemnumber++ {
+			c.InitDatasetItem(expected[:], itemnumber)
+			if actual := dataset.item(itemnumber); fmt.Sprint(actual) != fmt.Sprint(expected[:]) {
+				t.Errorf("item %d: expected %x, actual %x", itemnumber, expected, actual)
+			}
+		}
+	}
+
+	if err := dataset.Randomx_init_dataset(c, Randomx_dataset_item_count(), 1); !errors.Is(err, ErrInvalidDatasetRange) {
+		t.Errorf("past the end: expected ErrInvalidDatasetRange, actual %v", err)
+	}
+	if _, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, c, nil); !errors.Is(err, ErrDatasetNotAllocated) {
+		t.Errorf("no dataset: expected ErrDatasetNotAllocated, actual %v", err)
+	}
+
+	// a full dataset takes too long to build here, so only the items read by test a are computed
+	light, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingSource{Randomx_Cache: c}
+	light.source = recorder
+
+	input := []byte("This is a test")
+	var expected, actual [RANDOMX_HASH_SIZE]byte
+	if err := light.CalculateHash(input, expected[:]); err != nil {
+		t.Fatal(err)
+	}
+	for _, itemnumber := range recorder.items {
+		if err := dataset.Randomx_init_dataset(c, itemnumber, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	full, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, nil, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := full.CalculateHash(input, actual[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected {
+		t.Errorf("full memory mode: expected %x, actual %x", expected, actual)
+	}
+
+	// ranges initialized concurrently for a new key keep each other's chunks ready
+	concurrent, err := Randomx_alloc_dataset(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer concurrent.Close()
+	fresh, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, nil, concurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.CalculateHash(input, actual[:]); !errors.Is(err, ErrDatasetNotInitialized) {
+		t.Errorf("uninitialized dataset: expected ErrDatasetNotInitialized, actual %v", err)
+	}
+	errs := make(chan error, 2)
+	for chunk := uint64(0); chunk < 2; chunk++ {
+		go func(first uint64) {
+			errs <- concurrent.Randomx_init_dataset(c, first, datasetChunkItems)
+		}(chunk * datasetChunkItems)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !concurrent.itemReady(0) || !concurrent.itemReady(datasetChunkItems) || concurrent.key() != c.keyHash {
+		t.Errorf("concurrent ranges: expected both chunks ready for the cache key")
+	}
+}
+
+func Test_DatasetItems(t *testing.T) {
+	key := []byte("test key 000")
+	c := testCache(t)
+	dataset, err := Randomx_alloc_dataset(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataset.Close()
+
+	const count = 4
+	items := make([]byte, count*RANDOMX_DATASET_ITEM_SIZE)
+	for _, tt := range datasetItemTests {
+		if err := c.GetDatasetItems(tt.item, count, items); err != nil {
+			t.Fatal(err)
+		}
+		if actual := binary.LittleEndian.Uint64(items); actual != tt.expected {
+			t.Errorf("item %d: expected %x, actual %x", tt.item, tt.expected, actual)
+		}
+		if err := dataset.SetDatasetItems(key, tt.item, items); err != nil {
+			t.Fatal(err)
+		}
+		var expected [8]uint64
+		for itemnumber := tt.item; itemnumber < tt.item+count; itemnumber++ {
+			c.InitDatasetItem(expected[:], itemnumber)
+			if actual := dataset.item(itemnumber); fmt.Sprint(actual) != fmt.Sprint(expected[:]) {
+				t.Errorf("item %d: expected %x, actual %x", itemnumber, expected, actual)
+			}
+		}
+	}
+
+	last := Randomx_dataset_item_count() - 1
+	if err := c.GetDatasetItems(last, 1, items); err != nil {
+		t.Errorf("last item: %v", err)
+	}
+	if err := c.GetDatasetItems(last, 2, items); !errors.Is(err, ErrInvalidDatasetRange) {
+		t.Errorf("past the end: expected ErrInvalidDatasetRange, actual %v", err)
+	}
+	if err := c.GetDatasetItems(0, count+1, items); !errors.Is(err, ErrOutputTooSmall) {
+		t.Errorf("short dst: expected ErrOutputTooSmall, actual %v", err)
+	}
+	if err := dataset.SetDatasetItems(key, last, items); !errors.Is(err, ErrInvalidDatasetRange) {
+		t.Errorf("set past the end: expected ErrInvalidDatasetRange, actual %v", err)
+	}
+	if err := (&Randomx_Cache{}).GetDatasetItems(0, 1, items); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("uninitialized cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+}
+
+func Test_DatasetInitContext(t *testing.T) {
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Randomx_init_cache([]byte("test key 000")); err != nil {
+		t.Fatal(err)
+	}
+	dataset, err := Randomx_alloc_dataset(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// items split over goroutines must match the items computed one by one
+	first, count := uint64(100), uint64(3*datasetChunkItems+5)
+	var last, total uint64
+	progress := func(done, n uint64) {
+		if done <= last {
+			t.Errorf("progress went from %d to %d", last, done)
+		}
+		last, total = done, n
+	}
+	dataset.setKey(c.keyHash) // as InitContext does before computing items
+	if err := dataset.initParallel(context.Background(), c, c.keyHash, first, first+count, 4, progress); err != nil {
+		t.Fatal(err)
+	}
+	if last != count || total != count {
+		t.Errorf("progress: expected %d of %d, actual %d of %d", count, count, last, total)
+	}
+	for chunk, expected := range []bool{false, true, true, false} { // only chunks within the range are ready
+		if actual := dataset.itemReady(uint64(chunk) * datasetChunkItems); actual != expected {
+			t.Errorf("chunk %d: expected ready %v, actual %v", chunk, expected, actual)
+		}
+	}
+	var expected [8]uint64
+	for itemnumber := first; itemnumber < first+count; itemnumber += 997 {
+		c.InitDatasetItem(expected[:], itemnumber)
+		if actual := dataset.item(itemnumber); fmt.Sprint(actual) != fmt.Sprint(expected[:]) {
+			t.Errorf("item %d: expected %x, actual %x", itemnumber, expected, actual)
+		}
+	}
+
+	// a hybrid VM hashes while the dataset is being built, once the first chunk is ready
+	ctx, cancel := context.WithCancel(context.Background())
+	first_chunk := make(chan struct{})
+	var once sync.Once
+	init_err := make(chan error, 1)
+	go func() {
+		init_err <- dataset.InitContext(ctx, c, 1, func(done, total uint64) { once.Do(func() { close(first_chunk) }) })
+	}()
+	<-first_chunk
+
+	hybrid, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, c, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := hybrid.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("hybrid: unexpected hash %s", actual)
+	}
+
+	// cancelled initialization must not leave a usable dataset behind
+	cancel()
+	if err := <-init_err; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, actual %v", err)
+	}
+	if !dataset.itemReady(0) || dataset.itemReady(Randomx_dataset_item_count()-1) {
+		t.Errorf("expected only the first chunks to be ready")
+	}
+	full, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, nil, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := full.CalculateHash([]byte("This is a test"), output_hash[:]); !errors.Is(err, ErrDatasetNotInitialized) {
+		t.Errorf("cancelled dataset: expected ErrDatasetNotInitialized, actual %v", err)
+	}
+
+	// the cache is held a chunk at a time, so it can be rekeyed meanwhile, which stops the initialization
+	first_chunk = make(chan struct{})
+	once = sync.Once{}
+	go func() {
+		init_err <- dataset.InitContext(context.Background(), c, 1, func(done, total uint64) { once.Do(func() { close(first_chunk) }) })
+	}()
+	<-first_chunk
+	if err := c.Randomx_init_cache([]byte("test key 001")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-init_err; !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("rekeyed cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+
+	// the ready chunks hold items of the previous key, hybrid VMs compute every item from the rekeyed cache
+	// a hybrid VM created now does the same, the dataset may be rekeyed by an InitContext which just started
+	rekeyed, err := Randomx_create_vm(RANDOMX_FLAG_FULL_MEM, c, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	light, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected_hash [RANDOMX_HASH_SIZE]byte
+	if err := light.CalculateHash([]byte("This is a test"), expected_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := hybrid.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if output_hash != expected_hash {
+		t.Errorf("hybrid VM after rekey: expected %x, actual %x", expected_hash, output_hash)
+	}
+	if err := rekeyed.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if output_hash != expected_hash {
+		t.Errorf("hybrid VM created after rekey: expected %x, actual %x", expected_hash, output_hash)
+	}
+}
+
+func Test_DatasetFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 2 GiB dataset file in short mode")
+	}
+
+	c := testCache(t)
+	key := []byte("test key 000")
+	dataset, err := Randomx_alloc_dataset(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []uint64{0, 12345678, Randomx_dataset_item_count() - 1}
+	for _, itemnumber := range items {
+		if err := dataset.Randomx_init_dataset(c, itemnumber, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := t.TempDir() + "/dataset"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.WriteTo(f); !errors.Is(err, ErrDatasetNotInitialized) {
+		t.Errorf("partial dataset: expected ErrDatasetNotInitialized, actual %v", err)
+	}
+	dataset.setReady(true) // stands in for computing every item, which takes minutes
+	if _, err := dataset.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadDataset(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, itemnumber := range items {
+		if expected, actual := dataset.item(itemnumber), loaded.item(itemnumber); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("item %d: expected %x, actual %x", itemnumber, expected, actual)
+		}
+	}
+	if err := loaded.VerifyChecksum(); err != nil {
+		t.Error(err)
+	}
+	// the mapping is released like allocated memory, by Close or once the dataset is unreachable
+	if a := loaded.Allocation(); a.Size != RANDOMX_DATASET_ITEM_COUNT*RANDOMX_DATASET_ITEM_SIZE {
+		t.Errorf("loaded: unexpected allocation %+v", a)
+	}
+	if err := loaded.Close(); err != nil {
+		t.Error(err)
+	}
+	if loaded.memory.release != nil || loaded.memory.data != nil {
+		t.Error("loaded: mapping kept after Close")
+	}
+
+	if _, err := LoadDataset(path, []byte("test key 001")); !errors.Is(err, ErrFileMismatch) {
+		t.Errorf("other key: expected ErrFileMismatch, actual %v", err)
+	}
+
+	// flip one byte of an item, then of the magic
+	patch := func(offset int64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var b [1]byte
+		f.ReadAt(b[:], offset)
+		b[0] ^= 0xff
+		if _, err := f.WriteAt(b[:], offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patch(fileHeaderSize + 100)
+	if loaded, err = LoadDataset(path, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.VerifyChecksum(); !errors.Is(err, ErrInvalidFile) {
+		t.Errorf("corrupt item: expected ErrInvalidFile, actual %v", err)
+	}
+	loaded.Close()
+
+	patch(0)
+	if _, err := LoadDataset(path, key); !errors.Is(err, ErrInvalidFile) {
+		t.Errorf("bad magic: expected ErrInvalidFile, actual %v", err)
+	}
+
+	// words are found at offsets which are not page aligned, as happens with pages larger than the header
+	if f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	offset := int64(fileHeaderSize + 12345678*RANDOMX_DATASET_ITEM_SIZE)
+	words, unmap, err := mapWords(f, offset, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := dataset.item(12345678); fmt.Sprint(words) != fmt.Sprint(expected) {
+		t.Errorf("unaligned mapping: expected %x, actual %x", expected, words)
+	}
+	if unmap != nil {
+		unmap()
+	}
+}
+
+func Test_Argon2d(t *testing.T) {
+	// test vector of RFC 9106 section 5.1
+	B := make([]block, 32)
+	password := bytes.Repeat([]byte{1}, 32)
+	salt := bytes.Repeat([]byte{2}, 16)
+	secret := bytes.Repeat([]byte{3}, 8)
+	data := bytes.Repeat([]byte{4}, 12)
+	for _, flags := range argon2Flags() {
+		if err := buildBlocks(context.Background(), B, flags, nil, password, salt, secret, data, 3, 4, 32); err != nil {
+			t.Fatal(err)
+		}
+		if actual, expected := hex.EncodeToString(extractKey(B, 4, 32)), "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb"; actual != expected {
+			t.Errorf("%s tag: expected %s, actual %s", flags, expected, actual)
+		}
+	}
+
+	// every permutation must match the portable one
+	rng := rand.New(rand.NewSource(1))
+	for _, flags := range argon2Flags() {
+		permute := blamkaFor(flags)
+		for n := 0; n < 100; n++ {
+			var q block
+			for i := range q {
+				q[i] = rng.Uint64()
+			}
+			expected := q
+			blamkaGeneric(&expected)
+			if permute(&q); q != expected {
+				t.Errorf("%s permutation differs from blamkaGeneric", flags)
+				break
+			}
+		}
+	}
+
+	// lanes filled in parallel must match lanes filled in order
+	for _, lanes := range []uint32{2, 3, 8} {
+		parallel := make([]block, 64*lanes)
+		if err := buildBlocks(context.Background(), parallel, GetFlags(), nil, password, salt, secret, data, 2, uint8(lanes), 32); err != nil {
+			t.Fatal(err)
+		}
+		sequential := make([]block, len(parallel))
+		h0 := initHash(password, salt, secret, data, 2, uint32(len(sequential)), lanes, 32)
+		initBlocks(sequential, &h0, lanes)
+		processBlocks(context.Background(), sequential, 2, lanes, false, blamkaGeneric, nil)
+		for i := range sequential {
+			if parallel[i] != sequential[i] {
+				t.Errorf("%d lanes: block %d differs", lanes, i)
+				break
+			}
+		}
+	}
+
+	// cache memory of the reference implementation for key "test key 000"
+	c := testCache(t)
+	var Tests = []struct {
+		word     int
+		expected uint64
+	}{
+		{0, 0x191e0e1d23c02186},
+		{1568413, 0xf1b62fe6210bf8b1},
+		{33554431, 0x1f47f056d05cd99b},
+	}
+	words := blockWords(c.Blocks)
+	for _, tt := range Tests {
+		if actual := words[tt.word]; actual != tt.expected {
+			t.Errorf("cache word %d: expected %x, actual %x", tt.word, tt.expected, actual)
+		}
+	}
+}
+
+func Test_Allocation(t *testing.T) {
+	flags := RANDOMX_FLAG_LARGE_PAGES | RANDOMX_FLAG_LOCK_MEMORY
+	m := allocMemory(uint64(ScratchpadSize), flags)
+	if len(m.data) != int(ScratchpadSize) || m.Size != uint64(ScratchpadSize) {
+		t.Fatalf("expected %d bytes, actual %d", ScratchpadSize, len(m.data))
+	}
+	if !m.LargePages && !m.Transparent && m.Fallback == "" {
+		t.Errorf("large pages neither granted nor refused with a reason")
+	}
+	if !m.Locked && m.Fallback == "" {
+		t.Errorf("locking neither granted nor refused with a reason")
+	}
+	for i := range m.data {
+		if m.data[i] != 0 {
+			t.Fatalf("byte %d is not zeroed", i)
+		}
+		m.data[i] = byte(i)
+	}
+	if err := m.free(); err != nil {
+		t.Errorf("free: %v", err)
+	}
+	if err := m.free(); err != nil || m.data != nil {
+		t.Errorf("second free must do nothing, actual %v", err)
+	}
+
+	// hashes do not depend on how memory was obtained
+	h, err := NewHasher([]byte("test key 000"), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output_hash, err := h.Hash([]byte("This is a test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("unexpected hash %s", actual)
+	}
+	if a := h.Cache.Allocation(); a.Size != CacheSize {
+		t.Errorf("cache: unexpected allocation %+v", a)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Hash([]byte("This is a test")); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("closed cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+}
+
+func Test_SharedDataset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 2 GiB shared dataset in short mode")
+	}
+
+	c := testCache(t)
+	key := []byte("test key 000")
+	path := t.TempDir() + "/dataset"
+	ctx := context.Background()
+
+	// attachers wait for a builder until their context is done
+	wait_ctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	if _, err := AttachDataset(wait_ctx, path, key); !errors.Is(err, ErrDatasetNotInitialized) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("missing file: expected ErrDatasetNotInitialized after the deadline, actual %v", err)
+	}
+	cancel()
+
+	// attachers wait while a builder holds the lock
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockFile(ctx, lock, true); err != nil {
+		t.Fatal(err)
+	}
+	wait_ctx, cancel = context.WithTimeout(ctx, 300*time.Millisecond)
+	if _, err := AttachDataset(wait_ctx, path, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("locked file: expected context.DeadlineExceeded, actual %v", err)
+	}
+	cancel()
+	lock.Close()
+
+	// only a few items are computed, as a full build takes minutes
+	builds := 0
+	build := func(dataset *Randomx_Dataset) error {
+		builds++
+		for _, tt := range datasetItemTests {
+			if err := dataset.Randomx_init_dataset(c, tt.item, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	check := func(name string, dataset *Randomx_Dataset) {
+		for _, tt := range datasetItemTests {
+			if actual := dataset.item(tt.item)[0]; actual != tt.expected {
+				t.Errorf("%s: item %d expected %x, actual %x", name, tt.item, tt.expected, actual)
+			}
+		}
+	}
+
+	// an attacher started before the builder picks up the file once it is complete
+	wait_ctx, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	waiting := make(chan *Randomx_Dataset, 1)
+	go func() {
+		dataset, err := AttachDataset(wait_ctx, path, key)
+		if err != nil {
+			t.Error(err)
+		}
+		waiting <- dataset
+	}()
+
+	built, err := shareDataset(ctx, path, c.keyHash, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("built", built)
+	early := <-waiting
+	if early != nil {
+		check("waiting", early)
+		early.Close()
+	}
+	if err := built.InitContext(ctx, c, 1, nil); !errors.Is(err, ErrDatasetReadOnly) {
+		t.Errorf("shared dataset: expected ErrDatasetReadOnly, actual %v", err)
+	}
+
+	reused, err := shareDataset(ctx, path, c.keyHash, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 {
+		t.Errorf("expected the file to be built once, actual %d builds", builds)
+	}
+	check("reused", reused)
+
+	attached, err := AttachDataset(ctx, path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("attached", attached)
+	if err := attached.VerifyChecksum(); err != nil {
+		t.Error(err)
+	}
+	if _, err := AttachDataset(ctx, path, []byte("test key 001")); !errors.Is(err, ErrFileMismatch) {
+		t.Errorf("other key: expected ErrFileMismatch, actual %v", err)
+	}
+
+	for _, dataset := range []*Randomx_Dataset{built, reused, attached} {
+		if err := dataset.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if stale, _ := filepath.Glob(path + ".tmp*"); len(stale) != 0 {
+		t.Errorf("temporary files left behind: %v", stale)
+	}
+}
+
+func Test_CacheInitContext(t *testing.T) {
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// every argon2 slice then every program is reported once, in order
+	var reports []string
+	progress := func(stage CacheStage, done, total uint64) {
+		reports = append(reports, fmt.Sprintf("%s %d/%d", stage, done, total))
+	}
+	if err := c.InitContext(context.Background(), []byte("test key 000"), progress); err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i := 1; i <= RANDOMX_ARGON_ITERATIONS*syncPoints; i++ {
+		expected = append(expected, fmt.Sprintf("argon2 %d/%d", i, RANDOMX_ARGON_ITERATIONS*syncPoints))
+	}
+	for i := 1; i <= RANDOMX_PROGRAM_COUNT; i++ {
+		expected = append(expected, fmt.Sprintf("programs %d/%d", i, RANDOMX_PROGRAM_COUNT))
+	}
+	if strings.Join(reports, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("progress: expected %v, actual %v", expected, reports)
+	}
+	vm, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("unexpected hash %s", actual)
+	}
+
+	// cancelling a rekey stops at the next slice and leaves the cache uninitialized
+	cancelAfter := func(slices uint64) (context.Context, CacheProgress, *uint64) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var last uint64
+		return ctx, func(stage CacheStage, done, total uint64) {
+			if last = done; done == slices {
+				cancel()
+			}
+		}, &last
+	}
+	ctx, progress, last := cancelAfter(2)
+	if err := c.InitContext(ctx, []byte("test key 001"), progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, actual %v", err)
+	}
+	if *last != 2 {
+		t.Errorf("expected the fill to stop after 2 slices, actual %d", *last)
+	}
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("cancelled rekey: expected ErrCacheNotInitialized, actual %v", err)
+	}
+	if c.Allocation().Size != CacheSize {
+		t.Errorf("cancelled rekey: expected the blocks to be kept, actual %d bytes", c.Allocation().Size)
+	}
+	if err := c.Randomx_init_cache([]byte("test key 000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("rekeyed after cancel: unexpected hash %s", actual)
+	}
+
+	// a cache which had no key stays uninitialized
+	fresh, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	ctx, progress, _ = cancelAfter(1)
+	if err := fresh.InitContext(ctx, []byte("test key 001"), progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, actual %v", err)
+	}
+	if fresh.initialized() {
+		t.Errorf("cancelled cache is initialized")
+	}
+}
+
+func Test_CacheRekey(t *testing.T) {
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Randomx_release_cache()
+	if err := c.Randomx_init_cache([]byte("test key 001")); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := c.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same blocks are refilled for the next key and the VM follows the key of its cache
+	storage := &c.Blocks[0]
+	if err := c.Randomx_init_cache([]byte("test key 000")); err != nil {
+		t.Fatal(err)
+	}
+	if &c.Blocks[0] != storage {
+		t.Errorf("blocks were reallocated")
+	}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("rekeyed cache: unexpected hash %s", actual)
+	}
+
+	if err := c.Randomx_release_cache(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("released cache: expected ErrCacheNotInitialized, actual %v", err)
+	}
+}
+
+func Test_CacheFile(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("test key 000")
+
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := c.InitFromDir(dir, key); err != nil || loaded {
+		t.Fatalf("empty dir: expected computed cache, actual loaded %v err %v", loaded, err)
+	}
+
+	warm, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := warm.InitFromDir(dir, key); err != nil || !loaded {
+		t.Fatalf("expected loaded cache, actual loaded %v err %v", loaded, err)
+	}
+	for i := range c.Programs {
+		if c.Programs[i].String() != warm.Programs[i].String() {
+			t.Errorf("program %d differs after reload", i)
+		}
+	}
+	vm, err := warm.VM_Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output_hash [RANDOMX_HASH_SIZE]byte
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("loaded cache: unexpected hash %s", actual)
+	}
+
+	path := fmt.Sprintf("%s/%x.cache", dir, keyFingerprint(key))
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = warm.Load(f, []byte("test key 001"))
+	f.Close()
+	if !errors.Is(err, ErrFileMismatch) {
+		t.Errorf("other key: expected ErrFileMismatch, actual %v", err)
+	}
+
+	// a corrupt file is rejected and replaced by a recomputed one
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// files are read over the blocks of the previous key, a corrupt one leaves the cache uninitialized
+	storage := &warm.Blocks[0]
+	if err := warm.Load(bytes.NewReader(data), key); !errors.Is(err, ErrInvalidFile) {
+		t.Errorf("corrupt file: expected ErrInvalidFile, actual %v", err)
+	}
+	if err := vm.CalculateHash([]byte("This is a test"), output_hash[:]); !errors.Is(err, ErrCacheNotInitialized) {
+		t.Errorf("corrupt file: expected ErrCacheNotInitialized, actual %v", err)
+	}
+	if loaded, err := warm.InitFromDir(dir, key); err != nil || loaded {
+		t.Errorf("corrupt file: expected computed cache, actual loaded %v err %v", loaded, err)
+	}
+	if loaded, err := warm.InitFromDir(dir, key); err != nil || !loaded {
+		t.Errorf("rewritten file: expected loaded cache, actual loaded %v err %v", loaded, err)
+	}
+	if &warm.Blocks[0] != storage {
+		t.Errorf("blocks were reallocated")
+	}
+}
+
+func Test_ItemCache(t *testing.T) {
+	// one item per shard, so items of the same shard evict each other
+	items := NewItemCache(0)
+	var words, out [8]uint64
+	for _, itemnumber := range []uint64{1, 1 + itemCacheShards} {
+		words[0] = itemnumber
+		items.put(itemnumber, &words)
+	}
+	if items.get(1, &out) {
+		t.Errorf("item 1 should have been evicted")
+	}
+	if !items.get(1+itemCacheShards, &out) || out[0] != 1+itemCacheShards {
+		t.Errorf("item %d: expected cached, actual %v", 1+itemCacheShards, out)
+	}
+	if stats := items.Stats(); stats != (ItemCacheStats{Hits: 1, Misses: 1, Evictions: 1, Items: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var Tests = []struct {
+		key      []byte // key
+		input    []byte // input
+		expected string // expected result
+	}{
+		{[]byte("test key 000"), []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},                                                    // test a
+		{[]byte("test key 000"), []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},                                                    // test a, from memo
+		{[]byte("test key 001"), []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"), "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"}, // test d, after rekey
+	}
+
+	c, err := Randomx_alloc_cache(RANDOMX_FLAG_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Items = NewItemCache(64 << 20)
+
+	for i, tt := range Tests {
+		if i == 0 || string(tt.key) != string(Tests[i-1].key) {
+			if err := c.Randomx_init_cache(tt.key); err != nil {
+				t.Fatal(err)
+			}
+			if stats := c.Items.Stats(); stats.Items != 0 {
+				t.Errorf("rekey: expected empty item cache, actual %d items", stats.Items)
+			}
+		}
+		before := c.Items.Stats()
+
+		vm, err := c.VM_Initialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output_hash [RANDOMX_HASH_SIZE]byte
+		if err := vm.CalculateHash(tt.input, output_hash[:]); err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprintf("%x", output_hash); actual != tt.expected {
+			t.Errorf("hash %d: expected %s, actual %s", i, tt.expected, actual)
+		}
+
+		after := c.Items.Stats()
+		if repeated := i == 1; repeated != (after.Misses == before.Misses) {
+			t.Errorf("hash %d: unexpected stats before %+v after %+v", i, before, after)
+		}
+	}
+}
+
+func Test_SelectMode(t *testing.T) {
+	light := CacheSize + uint64(runtime.GOMAXPROCS(0))*uint64(ScratchpadSize)
+	full := light + RANDOMX_DATASET_ITEM_COUNT*RANDOMX_DATASET_ITEM_SIZE
+
+	var Tests = []struct {
+		budget     uint64
+		mode       Mode
+		item_cache uint64
+	}{
+		{64 << 30, ModeFull, 0},
+		{full, ModeFull, 0},
+		{full - 1, ModeLightMemo, full - 1 - light},
+		{light + minItemCacheSize, ModeLightMemo, minItemCacheSize},
+		{light + minItemCacheSize - 1, ModeLight, 0},
+		{1 << 20, ModeLight, 0},
+	}
+	for _, tt := range Tests {
+		s := SelectMode(tt.budget)
+		if s.Mode != tt.mode || s.ItemCache != tt.item_cache || s.Budget != tt.budget || s.Reason == "" {
+			t.Errorf("budget %d: expected %s with %d bytes of item cache, actual %+v", tt.budget, tt.mode, tt.item_cache, s)
+		}
+	}
+
+	meminfo := "MemTotal:       32657212 kB\nMemFree:         1385612 kB\nMemAvailable:   16303572 kB\n"
+	if available, err := parseMemAvailable(strings.NewReader(meminfo)); err != nil || available != 16303572<<10 {
+		t.Errorf("expected %d bytes available, actual %d err %v", uint64(16303572)<<10, available, err)
+	}
+	if _, err := parseMemAvailable(strings.NewReader("MemTotal:       32657212 kB\n")); err == nil {
+		t.Errorf("expected an error without MemAvailable")
+	}
+
+	// light mode with item cache must hash as the other modes
+	h, s, err := NewHasherForBudget([]byte("test key 000"), GetFlags(), light+minItemCacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if s.Mode != ModeLightMemo || h.Cache.Items == nil {
+		t.Fatalf("expected light mode with item cache, actual %s", s)
+	}
+	output_hash, err := h.Hash([]byte("This is a test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprintf("%x", output_hash); actual != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Errorf("unexpected hash %s", actual)
+	}
+}
+
+func Test_SeedHeight(t *testing.T) {
+	var Tests = []struct {
+		height, seed_height, next_height uint64
+	}{
+		{0, 0, 0},
+		{2048, 0, 0},
+		{2048 + 64, 0, 2048},
+		{2048 + 64 + 1, 2048, 2048},
+		{4096 + 64, 2048, 4096},
+		{4096 + 64 + 1, 4096, 4096},
+	}
+	for _, tt := range Tests {
+		if s, n := SeedHeights(tt.height); s != tt.seed_height || n != tt.next_height {
+			t.Errorf("height %d: expected %d %d, actual %d %d", tt.height, tt.seed_height, tt.next_height, s, n)
+		}
+	}
+}
+
+// hashes across a key switch are routed to the right cache
+func Test_SeedManager(t *testing.T) {
+	keys := map[uint64][]byte{0: []byte("test key 000"), 2048: []byte("test key 001"), 4096: []byte("test key 001")}
+	m := NewSeedManager(func(seed_height uint64) ([]byte, error) {
+		return keys[seed_height], nil
+	}, RANDOMX_FLAG_DEFAULT)
+
+	var Tests = []struct {
+		height   uint64
+		expected string
+	}{
+		{2100, "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"}, // test c, starts building the next cache
+		{2113, "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"}, // test d, drops the first cache
+		{4200, "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"}, // rekeys the first cache in place
+	}
+	var first *Randomx_Cache
+	for _, tt := range Tests {
+		output_hash, err := m.Hash(tt.height, []byte("sed do eiusmod tempor incididunt ut labore et dolore magna aliqua"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprintf("%x", output_hash); actual != tt.expected {
+			t.Errorf("height %d: expected %s, actual %s", tt.height, tt.expected, actual)
+		}
+		m.mu.Lock()
+		cache := m.entries[SeedHeight(tt.height)].hasher.Cache
+		m.mu.Unlock()
+		if first == nil {
+			first = cache
+		}
+	}
+	m.mu.Lock()
+	reused := m.entries[4096].hasher.Cache
+	m.mu.Unlock()
+	if reused != first {
+		t.Errorf("cache of the dropped seed was not reused")
+	}
+}
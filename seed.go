@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "sync"
+
+// Monero style key schedule, the key changes every SEEDHASH_EPOCH_BLOCKS blocks
+// and is taken from a block SEEDHASH_EPOCH_LAG blocks older than the switch
+const SEEDHASH_EPOCH_BLOCKS = 2048
+const SEEDHASH_EPOCH_LAG = 64
+
+// height of the block whose hash keys RandomX at height, same as monero rx_seedheight
+func SeedHeight(height uint64) uint64 {
+	if height <= SEEDHASH_EPOCH_BLOCKS+SEEDHASH_EPOCH_LAG {
+		return 0
+	}
+	return (height - SEEDHASH_EPOCH_LAG - 1) &^ (SEEDHASH_EPOCH_BLOCKS - 1)
+}
+
+// seed height at height, and the seed height which will be used SEEDHASH_EPOCH_LAG blocks later
+func SeedHeights(height uint64) (seed_height, next_height uint64) {
+	return SeedHeight(height), SeedHeight(height + SEEDHASH_EPOCH_LAG)
+}
+
+// SeedFunc returns the key for a seed height, usually the hash of the block at that height
+type SeedFunc func(seed_height uint64) ([]byte, error)
+
+type seedEntry struct {
+	ready  chan struct{} // closed once hasher or err is set
+	hasher *Hasher
+	err    error
+
+	// guarded by SeedManager.mu
+	users   int  // Hash calls using hasher
+	escaped bool // hasher was returned by Hasher, so its cache is never recycled
+	dropped bool // evicted, its cache is recycled once built and unused
+}
+
+// SeedManager routes hashes to the cache of the right key for a block height
+// it keeps the caches of the current and the next seed, the next one is built in the background
+// as soon as a height within SEEDHASH_EPOCH_LAG blocks of the switch is seen
+// the cache of a dropped seed is rekeyed in place for the next seed, so memory stays flat as seeds rotate
+// a SeedManager is safe for concurrent use
+type SeedManager struct {
+	// when set before first use, caches are loaded from and saved to this directory, see InitFromDir
+	CacheDir string
+
+	seed  SeedFunc
+	flags Flags
+
+	mu      sync.Mutex
+	tip     uint64                // highest height seen
+	entries map[uint64]*seedEntry // by seed height
+	spare   *Randomx_Cache        // cache of a dropped seed, waiting for the next one
+}
+
+func NewSeedManager(seed SeedFunc, flags Flags) *SeedManager {
+	return &SeedManager{seed: seed, flags: flags, entries: map[uint64]*seedEntry{}}
+}
+
+// calculate RandomX hash of blob with the key scheduled for height
+func (m *SeedManager) Hash(height uint64, blob []byte) (output [RANDOMX_HASH_SIZE]byte, err error) {
+	e := m.lookup(height, false)
+	defer m.done(e)
+
+	<-e.ready
+	if e.err != nil {
+		return output, e.err
+	}
+	return e.hasher.Hash(blob)
+}
+
+// hasher keyed for height, waits if its cache is still being built
+// the hasher stays usable after its seed is dropped, so its cache is left to the garbage collector then
+func (m *SeedManager) Hasher(height uint64) (*Hasher, error) {
+	e := m.lookup(height, true)
+	defer m.done(e)
+
+	<-e.ready
+	return e.hasher, e.err
+}
+
+// entry for the seed of height, used until done is called
+// caches no longer needed at the highest height seen are dropped
+func (m *SeedManager) lookup(height uint64, escape bool) *seedEntry {
+	seed_height, next_height := SeedHeights(height)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if height > m.tip {
+		m.tip = height
+	}
+	e := m.entry(seed_height)
+	if next_height != seed_height {
+		m.entry(next_height) // precompute next cache in background
+	}
+	e.users++
+	e.escaped = e.escaped || escape
+	m.evict(seed_height)
+	return e
+}
+
+// end a use of e started by lookup
+func (m *SeedManager) done(e *seedEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.users--
+	m.recycle(e)
+}
+
+// returns entry for seed_height, starting its build if unknown, m.mu must be held
+func (m *SeedManager) entry(seed_height uint64) *seedEntry {
+	if e, ok := m.entries[seed_height]; ok {
+		return e
+	}
+
+	e := &seedEntry{ready: make(chan struct{})}
+	m.entries[seed_height] = e
+	cache := m.spare
+	m.spare = nil
+
+	go func() {
+		key, err := m.seed(seed_height)
+		if err == nil {
+			e.hasher, e.err = m.newHasher(key, cache)
+		} else {
+			e.err = err
+			if cache != nil {
+				cache.Close()
+			}
+		}
+		close(e.ready)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if e.err != nil { // forget failures so that the next request retries
+			if m.entries[seed_height] == e {
+				delete(m.entries, seed_height)
+			}
+			return
+		}
+		m.recycle(e) // dropped while it was built
+	}()
+	return e
+}
+
+// build a hasher for key, rekeying cache in place when it is not nil and warm starting from CacheDir when set
+func (m *SeedManager) newHasher(key []byte, cache *Randomx_Cache) (h *Hasher, err error) {
+	if cache == nil {
+		if cache, err = Randomx_alloc_cache(m.flags); err != nil {
+			return nil, err
+		}
+	}
+	if m.CacheDir == "" {
+		err = cache.Randomx_init_cache(key)
+	} else {
+		_, err = cache.InitFromDir(m.CacheDir, key)
+	}
+	if err == nil {
+		h, err = NewHasherFromCache(cache, m.flags)
+	}
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	h.ownCache = true
+	return h, nil
+}
+
+// drop caches of seeds other than current and next at tip, except the one just requested, m.mu must be held
+func (m *SeedManager) evict(requested uint64) {
+	seed_height, next_height := SeedHeights(m.tip)
+	for s, e := range m.entries {
+		if s != seed_height && s != next_height && s != requested {
+			delete(m.entries, s)
+			e.dropped = true
+			m.recycle(e)
+		}
+	}
+}
+
+// keep the cache of a dropped entry nobody uses any more as the spare, or release it, m.mu must be held
+func (m *SeedManager) recycle(e *seedEntry) {
+	if !e.dropped || e.users > 0 || e.escaped {
+		return
+	}
+	select {
+	case <-e.ready:
+	default:
+		return // still building, recycled when done
+	}
+	if e.hasher == nil {
+		return // failed, or recycled already
+	}
+
+	h := e.hasher
+	e.hasher = nil
+	if h.Dataset != nil {
+		h.Dataset.Close()
+	}
+	if m.spare == nil {
+		m.spare = h.Cache
+	} else {
+		h.Cache.Close()
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "os"
+import "fmt"
+import "time"
+import "errors"
+import "context"
+import "path/filepath"
+
+// ShareDataset returns the dataset for the key of cache stored in the file at path, usually below /dev/shm
+// so that several processes on a host hold a single copy. the first caller computes the items into the file,
+// as InitContext does, while holding an exclusive lock on path.lock, later callers map the finished file
+// a file built for another key is replaced, processes still using it keep their mapping of the old file
+// the returned dataset is read only, it must not be initialized again
+func ShareDataset(ctx context.Context, path string, cache *Randomx_Cache, threads int, progress DatasetProgress) (*Randomx_Dataset, error) {
+	if cache == nil {
+		return nil, ErrCacheNotInitialized
+	}
+	cache.mu.RLock()
+	initialized, keyHash := cache.initialized(), cache.keyHash
+	cache.mu.RUnlock()
+	if !initialized {
+		return nil, ErrCacheNotInitialized
+	}
+
+	return shareDataset(ctx, path, keyHash, func(dataset *Randomx_Dataset) error {
+		return dataset.InitContext(ctx, cache, threads, progress)
+	})
+}
+
+// AttachDataset maps the dataset shared at path by ShareDataset in another process, read only
+// it waits while the file is being built, or until a builder shows up, for as long as ctx allows
+// fails with ErrDatasetNotInitialized if nobody has built it by then and with ErrFileMismatch if it was built for another key
+func AttachDataset(ctx context.Context, path string, key []byte) (*Randomx_Dataset, error) {
+	keyHash := keyFingerprint(key)
+	for {
+		lock, err := os.OpenFile(path+".lock", os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		// the shared lock is dropped between attempts so a builder can take it
+		err = lockFile(ctx, lock, false)
+		var dataset *Randomx_Dataset
+		if err == nil {
+			dataset, err = attachDataset(path, keyHash)
+		}
+		lock.Close()
+		if !errors.Is(err, os.ErrNotExist) {
+			return dataset, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrDatasetNotInitialized, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// return the dataset at path if it was built for keyHash, otherwise build it with build into a new file
+// the new file only replaces path once complete, so its header is the marker attachers look for
+func shareDataset(ctx context.Context, path string, keyHash [32]byte, build func(dataset *Randomx_Dataset) error) (*Randomx_Dataset, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	if err := lockFile(ctx, lock, true); err != nil {
+		return nil, err
+	}
+	dataset, err := attachDataset(path, keyHash)
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrFileMismatch) && !errors.Is(err, ErrInvalidFile) {
+		return dataset, err
+	}
+
+	// only the lock holder builds, so other temporary files were left by a builder which died
+	if stale, err := filepath.Glob(path + ".tmp*"); err == nil {
+		for _, name := range stale {
+			os.Remove(name)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(0644); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(datasetFileSize)); err != nil {
+		return nil, err
+	}
+	words, unmap, err := mapSharedWords(f, fileHeaderSize, RANDOMX_DATASET_ITEM_COUNT*8, true)
+	if err != nil {
+		return nil, err
+	}
+	dataset = &Randomx_Dataset{Memory: words, memory: mappedMemory(words, unmap)}
+	if err := build(dataset); err != nil {
+		dataset.Close()
+		return nil, err
+	}
+
+	sum := checksumWords(dataset.Memory)
+	dataset.setChecksum(sum)
+	header := fileHeader{
+		magic:     datasetMagic,
+		version:   fileVersion,
+		itemSize:  uint32(RANDOMX_DATASET_ITEM_SIZE),
+		params:    parametersFingerprint(),
+		keyHash:   dataset.key(),
+		itemCount: RANDOMX_DATASET_ITEM_COUNT,
+		checksum:  sum,
+	}
+	if _, err := f.WriteAt(header.marshal(), 0); err != nil {
+		dataset.Close()
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		dataset.Close()
+		return nil, err
+	}
+	dataset.shared = true
+	return dataset, nil
+}
+
+// map the dataset file at path read only, the caller holds path.lock
+func attachDataset(path string, keyHash [32]byte) (*Randomx_Dataset, error) {
+	f, header, err := openDatasetFile(path, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words, unmap, err := mapSharedWords(f, fileHeaderSize, RANDOMX_DATASET_ITEM_COUNT*8, false)
+	if err != nil {
+		return nil, err
+	}
+	dataset := &Randomx_Dataset{Memory: words, checksum: header.checksum, memory: mappedMemory(words, unmap), shared: true}
+	dataset.setKey(header.keyHash)
+	dataset.setReady(true)
+	return dataset, nil
+}
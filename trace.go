@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2019 DERO Foundation. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+this list of conditions and the following disclaimer in the documentation
+and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+may be used to endorse or promote products derived from this software without
+specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package randomx
+
+import "fmt"
+import "io"
+import "sync"
+import "time"
+
+// TraceLevel orders events by verbosity, a tracer receives every event at or below its level
+type TraceLevel int
+
+const (
+	TraceOff   TraceLevel = iota
+	TraceInfo             // cache and dataset initialized, final hashes
+	TraceDebug            // superscalar programs, intermediate chain hashes
+)
+
+type TraceEventType int
+
+const (
+	TraceCacheInit TraceEventType = iota
+	TraceProgramBuilt
+	TraceChainHash
+	TraceFinalHash
+	TraceDatasetInit
+)
+
+func (t TraceEventType) String() string {
+	switch t {
+	case TraceCacheInit:
+		return "cache init"
+	case TraceProgramBuilt:
+		return "program built"
+	case TraceChainHash:
+		return "chain hash"
+	case TraceFinalHash:
+		return "final hash"
+	case TraceDatasetInit:
+		return "dataset init"
+	default:
+		return fmt.Sprintf("TraceEventType(%d)", int(t))
+	}
+}
+
+// level at which an event is generated
+func (t TraceEventType) Level() TraceLevel {
+	switch t {
+	case TraceCacheInit, TraceDatasetInit, TraceFinalHash:
+		return TraceInfo
+	default:
+		return TraceDebug
+	}
+}
+
+// TraceEvent carries the fields relevant to its Type, others are left zero
+// the event and its Hash are only valid during the Trace call
+type TraceEvent struct {
+	Type     TraceEventType
+	Duration time.Duration       // TraceCacheInit, TraceDatasetInit
+	Index    int                 // program number for TraceProgramBuilt, chain number for TraceChainHash, first item for TraceDatasetInit
+	Program  *SuperScalarProgram // TraceProgramBuilt
+	Hash     []byte              // TraceChainHash, TraceFinalHash
+}
+
+// Tracer receives diagnostics, it can be attached to a cache and to a VM
+// no events are generated when no tracer is attached
+type Tracer interface {
+	Level() TraceLevel
+	Trace(ev *TraceEvent)
+}
+
+// whether an event of type typ should be built and sent to t
+func tracing(t Tracer, typ TraceEventType) bool {
+	return t != nil && t.Level() >= typ.Level()
+}
+
+type writerTracer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level TraceLevel
+}
+
+// returns a tracer which prints one line per event to w, it is safe for concurrent use
+func NewWriterTracer(w io.Writer, level TraceLevel) Tracer {
+	return &writerTracer{w: w, level: level}
+}
+
+func (t *writerTracer) Level() TraceLevel {
+	return t.level
+}
+
+func (t *writerTracer) Trace(ev *TraceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch ev.Type {
+	case TraceCacheInit:
+		fmt.Fprintf(t.w, "%s: %s\n", ev.Type, ev.Duration)
+	case TraceDatasetInit:
+		fmt.Fprintf(t.w, "%s: from item %d %s\n", ev.Type, ev.Index, ev.Duration)
+	case TraceProgramBuilt:
+		fmt.Fprintf(t.w, "%s: %d, %d instructions, address reg r%d\n", ev.Type, ev.Index, len(ev.Program.Ins), ev.Program.AddressReg)
+	case TraceChainHash:
+		fmt.Fprintf(t.w, "%s: %d %x\n", ev.Type, ev.Index, ev.Hash)
+	default:
+		fmt.Fprintf(t.w, "%s: %x\n", ev.Type, ev.Hash)
+	}
+}
@@ -29,9 +29,9 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package randomx
 
-import "fmt"
 import "math"
 import "math/big"
+import "hash"
 import "math/bits"
 import "encoding/binary"
 import "golang.org/x/crypto/blake2b"
@@ -41,11 +41,13 @@ type REG struct {
 	Lo uint64
 }
 
+// a VM holds mutable scratch state and must only be used by one goroutine at a time
+// use VMPool to hash concurrently over a shared cache
 type VM struct {
 	State_start [64]byte
 	buffer      [RANDOMX_PROGRAM_SIZE*8 + 16*8]byte // first 128 bytes are entropy below rest are program bytes
 	Prog        []byte
-	ScratchPad  []byte
+	ScratchPad  []byte // only valid while the VM is reachable and not closed
 
 	ByteCode [RANDOMX_PROGRAM_SIZE]InstructionByteCode
 
@@ -60,15 +62,91 @@ type VM struct {
 
 	RoundingMode big.RoundingMode
 
-	fresult, fdst, fsrc *big.Float
+	Cache   *Randomx_Cache   // randomx cache, may be nil in full memory mode
+	Dataset *Randomx_Dataset // read in full memory mode, nil in light mode
 
-	Cache *Randomx_Cache // randomx cache
+	Flags Flags // flags the VM was created with
 
+	Tracer Tracer // receives diagnostics, may be nil
+
+	tempHash  [64]byte // seed of the pending pipelined hash
+	pipelined bool     // CalculateHashFirst was called and the scratchpad holds its input
+
+	// hashing state owned by the VM so that calculating a hash does not allocate
+	hash512, hash256 hash.Hash
+	chainHash        [64]byte                  // seed of the program currently running
+	registers        [REGISTERSCOUNT * 32]byte // serialized register file r, f, e and a
+
+	source     datasetSource // cache or dataset, depending on RANDOMX_FLAG_FULL_MEM
+	mixBlock   [8]uint64     // dataset item read during current iteration
+	scratchpad *memory       // backs ScratchPad
+}
+
+// create a VM with default flags
+func (cache *Randomx_Cache) VM_Initialize() (*VM, error) {
+	return Randomx_create_vm(RANDOMX_FLAG_DEFAULT, cache, nil)
+}
+
+// create a VM, fails if flags request a VM feature which is not available
+// with RANDOMX_FLAG_FULL_MEM the VM reads dataset, which must be allocated, and cache may be nil
+// if cache is given as well the VM is hybrid, it computes items of chunks InitContext has not finished from cache
+// otherwise dataset is ignored and the VM computes every item from cache, which must be initialized
+func Randomx_create_vm(flags Flags, cache *Randomx_Cache, dataset *Randomx_Dataset) (*VM, error) {
+	if err := checkFlags(flags, vmFlags); err != nil {
+		return nil, err
+	}
+
+	vm := &VM{Cache: cache, Flags: flags & vmFlags, RoundingMode: big.ToNearestEven} //// setup the cache
+	if flags&RANDOMX_FLAG_FULL_MEM != 0 {
+		if dataset == nil {
+			return nil, ErrDatasetNotAllocated
+		}
+		vm.Dataset = dataset
+		vm.source = dataset
+		if cache != nil {
+			cache.mu.RLock()
+			initialized := cache.initialized()
+			cache.mu.RUnlock()
+			if !initialized {
+				return nil, ErrCacheNotInitialized
+			}
+			vm.source = &hybridSource{cache: cache, dataset: dataset}
+		}
+	} else {
+		if cache == nil {
+			return nil, ErrCacheNotInitialized
+		}
+		cache.mu.RLock()
+		initialized := cache.initialized()
+		cache.mu.RUnlock()
+		if !initialized {
+			return nil, ErrCacheNotInitialized
+		}
+		vm.source = cache
+	}
+	if cache != nil {
+		vm.Tracer = cache.Tracer
+	}
+
+	vm.scratchpad = allocMemory(uint64(ScratchpadSize), vm.Flags)
+	vm.ScratchPad = vm.scratchpad.data
+	vm.hash512, _ = blake2b.New512(nil)
+	vm.hash256, _ = blake2b.New256(nil)
+	return vm, nil
 }
 
-func (cache *Randomx_Cache) VM_Initialize() *VM {
+// how the memory of the scratchpad was obtained
+func (vm *VM) Allocation() Allocation {
+	if vm.scratchpad == nil {
+		return Allocation{}
+	}
+	return vm.scratchpad.Allocation
+}
 
-	return &VM{Cache: cache, RoundingMode: big.ToNearestEven, fresult: &big.Float{}, fdst: &big.Float{}, fsrc: &big.Float{}} //// setup the cache
+// release the scratchpad, the VM cannot be used afterwards
+func (vm *VM) Close() error {
+	vm.ScratchPad = nil
+	return vm.scratchpad.free()
 }
 
 type Config struct {
@@ -93,10 +171,6 @@ const HIGH = 1
 // calculate hash based on input
 func (vm *VM) Run(input_hash []byte) {
 
-	var mix_block [8]uint64
-
-	fmt.Printf("%x \n", input_hash)
-
 	fillAes4Rx4(input_hash[:], vm.buffer[:])
 
 	for i := range vm.entropy {
@@ -133,8 +207,6 @@ func (vm *VM) Run(input_hash []byte) {
 	vm.config.eMask[0] = getFloatMask(vm.entropy[14])
 	vm.config.eMask[1] = getFloatMask(vm.entropy[15])
 
-	fmt.Printf("prog %x  entropy 0 %x %f \n", vm.buffer[:32], vm.entropy[0], vm.reg.a[0][HIGH])
-
 	vm.Compile_TO_Bytecode()
 
 	spAddr0 := vm.mem.mx
@@ -189,10 +261,10 @@ func (vm *VM) Run(input_hash []byte) {
 			itemnumber := (vm.datasetOffset + vm.mem.ma) / CacheLineSize
 			//fmt.Printf("qitem number %x\n", itemnumber)
 
-			vm.Cache.InitDatasetItem(mix_block[:], itemnumber)
+			vm.source.readItem(&vm.mixBlock, itemnumber)
 
 			for i := range vm.reg.r {
-				vm.reg.r[i] ^= mix_block[i]
+				vm.reg.r[i] ^= vm.mixBlock[i]
 			}
 
 		}
@@ -222,91 +294,144 @@ func (vm *VM) Run(input_hash []byte) {
 
 }
 
-func (vm *VM) CalculateHash(input []byte, output []byte) {
-	var buf [8]byte
+// calculate hash of input into output, which must hold at least RANDOMX_HASH_SIZE bytes
+func (vm *VM) CalculateHash(input []byte, output []byte) (err error) {
+	if len(output) < RANDOMX_HASH_SIZE {
+		return ErrOutputTooSmall
+	}
 
-	vm.RoundingMode = big.ToNearestEven // reset rounding mode if new hash eing calculated
+	if err := vm.source.acquire(); err != nil { // cache cannot be rekeyed while hashing
+		return err
+	}
+	defer vm.source.release()
+	defer recoverError(&err)
 
-	input_hash := blake2b.Sum512(input)
+	vm.pipelined = false // scratchpad of a pending pipelined hash is overwritten below
 
-	vm.ScratchPad = make([]byte, ScratchpadSize, ScratchpadSize) // calculate and fill scratchpad
-	fillAes1Rx4(input_hash[:], vm.ScratchPad)
+	vm.chainHash = blake2b.Sum512(input)
+	fillAes1Rx4(vm.chainHash[:], vm.ScratchPad) // calculate and fill scratchpad
 
-	hash512, _ := blake2b.New512(nil)
+	vm.runChain(vm.chainHash[:])
 
-	temp_hash := input_hash[:]
+	// now hash the scratch pad and place into register a
+	hashAes1Rx4(vm.ScratchPad, vm.chainHash[:])
+	vm.finalResult(vm.chainHash[:], output)
+	return nil
+}
 
-	for chain := 0; chain < RANDOMX_PROGRAM_COUNT-1; chain++ {
-		vm.Run(temp_hash)
+// start a pipelined hash of input, only the scratchpad is prepared here
+// afterwards call CalculateHashNext for every further input and CalculateHashLast for the final one
+func (vm *VM) CalculateHashFirst(input []byte) (err error) {
+	defer recoverError(&err)
 
-		hash512.Reset()
-		for i := range vm.reg.r {
-			binary.LittleEndian.PutUint64(buf[:], vm.reg.r[i])
-			hash512.Write(buf[:])
-		}
-		for i := range vm.reg.f {
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.f[i][LOW]))
-			hash512.Write(buf[:])
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.f[i][HIGH]))
-			hash512.Write(buf[:])
-		}
+	vm.tempHash = blake2b.Sum512(input)
+	fillAes1Rx4(vm.tempHash[:], vm.ScratchPad)
+	vm.pipelined = true
+	return nil
+}
 
-		for i := range vm.reg.e {
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.e[i][LOW]))
-			hash512.Write(buf[:])
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.e[i][HIGH]))
-			hash512.Write(buf[:])
-		}
+// finish the hash of the previous input into output, and prepare the scratchpad for nextInput in the same pass
+func (vm *VM) CalculateHashNext(nextInput []byte, output []byte) (err error) {
+	if len(output) < RANDOMX_HASH_SIZE {
+		return ErrOutputTooSmall
+	}
+	if !vm.pipelined {
+		return ErrHashNotStarted
+	}
 
-		for i := range vm.reg.a {
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.a[i][LOW]))
-			hash512.Write(buf[:])
-			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.a[i][HIGH]))
+	if err := vm.source.acquire(); err != nil {
+		return err
+	}
+	defer vm.source.release()
+	defer recoverError(&err)
 
-			hash512.Write(buf[:])
-		}
+	vm.chainHash = vm.tempHash
+	vm.tempHash = blake2b.Sum512(nextInput)
 
-		temp_hash = hash512.Sum(nil)
-		fmt.Printf("%d temphash %x\n", chain, temp_hash)
+	vm.runChain(vm.chainHash[:])
+
+	// hash the scratchpad into register a while filling it for the next input
+	hashAndFillAes1Rx4(vm.ScratchPad, vm.chainHash[:], vm.tempHash[:])
+	vm.finalResult(vm.chainHash[:], output)
+	return nil
+}
+
+// finish the hash of the last input passed to CalculateHashFirst or CalculateHashNext
+func (vm *VM) CalculateHashLast(output []byte) (err error) {
+	if len(output) < RANDOMX_HASH_SIZE {
+		return ErrOutputTooSmall
+	}
+	if !vm.pipelined {
+		return ErrHashNotStarted
 	}
 
-	// final loop executes here
-	vm.Run(temp_hash)
+	if err := vm.source.acquire(); err != nil {
+		return err
+	}
+	defer vm.source.release()
+	defer recoverError(&err)
 
-	// now hash the scratch pad and place into register a
-	hashAes1Rx4(vm.ScratchPad, temp_hash)
+	vm.pipelined = false
 
-	hash256, _ := blake2b.New256(nil)
+	vm.chainHash = vm.tempHash
+	vm.runChain(vm.chainHash[:])
 
-	hash256.Reset()
+	hashAes1Rx4(vm.ScratchPad, vm.chainHash[:])
+	vm.finalResult(vm.chainHash[:], output)
+	return nil
+}
 
-	for i := range vm.reg.r {
-		binary.LittleEndian.PutUint64(buf[:], vm.reg.r[i])
-		hash256.Write(buf[:])
-	}
+// execute all chained programs on an already filled scratchpad, seeded by temp_hash
+func (vm *VM) runChain(temp_hash []byte) {
+	vm.RoundingMode = big.ToNearestEven // reset rounding mode if new hash eing calculated
 
-	for i := range vm.reg.f {
-		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.f[i][LOW]))
-		hash256.Write(buf[:])
-		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.f[i][HIGH]))
-		hash256.Write(buf[:])
-	}
+	for chain := 0; chain < RANDOMX_PROGRAM_COUNT-1; chain++ {
+		vm.Run(temp_hash)
+
+		vm.hash512.Reset()
+		vm.hash512.Write(vm.serializeRegisters())
+		temp_hash = vm.hash512.Sum(temp_hash[:0])
 
-	for i := range vm.reg.e {
-		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.e[i][LOW]))
-		hash256.Write(buf[:])
-		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(vm.reg.e[i][HIGH]))
-		hash256.Write(buf[:])
+		if tracing(vm.Tracer, TraceChainHash) {
+			vm.Tracer.Trace(&TraceEvent{Type: TraceChainHash, Index: chain, Hash: temp_hash})
+		}
 	}
 
+	// final loop executes here
+	vm.Run(temp_hash)
+}
+
+// final hash is calculated from the registers with register a replaced by scratchpad hash
+func (vm *VM) finalResult(scratchpad_hash []byte, output []byte) {
+	vm.hash256.Reset()
+
+	registers := vm.serializeRegisters()
+	vm.hash256.Write(registers[:len(registers)-len(vm.reg.a)*16])
+
 	// copy temp_hash as it first copied to register and then hashed
-	hash256.Write(temp_hash)
+	vm.hash256.Write(scratchpad_hash)
+
+	final_hash := vm.hash256.Sum(output[:0])
 
-	final_hash := hash256.Sum(nil)
+	if tracing(vm.Tracer, TraceFinalHash) {
+		vm.Tracer.Trace(&TraceEvent{Type: TraceFinalHash, Hash: final_hash})
+	}
+}
 
-	copy(output, final_hash)
+// write registers r, f, e and a in little endian form into the VM owned buffer
+func (vm *VM) serializeRegisters() []byte {
+	buf := vm.registers[:0]
 
-	fmt.Printf("final %x\n", final_hash)
+	for i := range vm.reg.r {
+		buf = binary.LittleEndian.AppendUint64(buf, vm.reg.r[i])
+	}
+	for _, group := range [...]*[4][2]float64{&vm.reg.f, &vm.reg.e, &vm.reg.a} {
+		for i := range group {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(group[i][LOW]))
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(group[i][HIGH]))
+		}
+	}
+	return buf
 }
 
 /*
@@ -29,7 +29,6 @@ USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package randomx
 
-import "fmt"
 import "math"
 import "math/big"
 import "math/bits"
@@ -516,9 +515,6 @@ func (vm *VM) Compile_TO_Bytecode() {
 				ibc.memMask = ScratchpadL3Mask
 			}
 
-		default:
-			panic("unreachable")
-
 		}
 	}
 
@@ -677,120 +673,27 @@ func (vm *VM) InterpretByteCode() {
 		//	fmt.Printf("%+v \n",ibc.fdst )
 		//	panic("VM_FSWAP_R")
 		case VM_FADD_R:
-			//ibc.fdst[LOW] += ibc.fsrc[LOW]
-			//ibc.fdst[HIGH] += ibc.fsrc[HIGH]
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[LOW])
-			vm.fresult.Add(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[HIGH])
-			vm.fresult.Add(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//panic("VM_FADD_R")
+			ibc.fdst[LOW] = fadd(ibc.fdst[LOW], ibc.fsrc[LOW], vm.RoundingMode)
+			ibc.fdst[HIGH] = fadd(ibc.fdst[HIGH], ibc.fsrc[HIGH], vm.RoundingMode)
 		case VM_FADD_M:
-			//ibc.fdst[LOW] += float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress()+0)))
-			//ibc.fdst[HIGH] += float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress()+4)))
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 0))))
-			vm.fresult.Add(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 4))))
-			vm.fresult.Add(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//panic("VM_FADD_M")
+			lo := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 0)))
+			high := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 4)))
+			ibc.fdst[LOW] = fadd(ibc.fdst[LOW], lo, vm.RoundingMode)
+			ibc.fdst[HIGH] = fadd(ibc.fdst[HIGH], high, vm.RoundingMode)
 		case VM_FSUB_R:
-			//fmt.Printf("Rounding mode %d\n", vm.RoundingMode)
-			//ibc.fdst[LOW] -= ibc.fsrc[LOW]
-			//ibc.fdst[HIGH] -= ibc.fsrc[HIGH]
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[LOW])
-			vm.fresult.Sub(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[HIGH])
-			vm.fresult.Sub(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//fmt.Printf("fdst float %+v\n", ibc.fdst  )
-			//panic("VM_FSUB_R")
+			ibc.fdst[LOW] = fsub(ibc.fdst[LOW], ibc.fsrc[LOW], vm.RoundingMode)
+			ibc.fdst[HIGH] = fsub(ibc.fdst[HIGH], ibc.fsrc[HIGH], vm.RoundingMode)
 		case VM_FSUB_M:
-			//ibc.fdst[LOW] -= float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress()+0)))
-			//ibc.fdst[HIGH] -= float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress()+4)))
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 0))))
-			vm.fresult.Sub(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 4))))
-			vm.fresult.Sub(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//panic("VM_FSUB_M")
+			lo := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 0)))
+			high := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 4)))
+			ibc.fdst[LOW] = fsub(ibc.fdst[LOW], lo, vm.RoundingMode)
+			ibc.fdst[HIGH] = fsub(ibc.fdst[HIGH], high, vm.RoundingMode)
 		case VM_FSCAL_R: // no dependent on rounding modes
-			//mask := math.Float64frombits(0x80F0000000000000)
 			ibc.fdst[LOW] = math.Float64frombits(math.Float64bits(ibc.fdst[LOW]) ^ 0x80F0000000000000)
 			ibc.fdst[HIGH] = math.Float64frombits(math.Float64bits(ibc.fdst[HIGH]) ^ 0x80F0000000000000)
-
-			//fmt.Printf("fdst float %+v\n", ibc.fdst  )
-			//panic("VM_FSCA_M")
 		case VM_FMUL_R:
-
-			//	ibc.fdst[LOW] *= ibc.fsrc[LOW]
-			//	ibc.fdst[HIGH] *= ibc.fsrc[HIGH]
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[LOW])
-			vm.fresult.Mul(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(ibc.fsrc[HIGH])
-			vm.fresult.Mul(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//panic("VM_FMUK_M")
+			ibc.fdst[LOW] = fmul(ibc.fdst[LOW], ibc.fsrc[LOW], vm.RoundingMode)
+			ibc.fdst[HIGH] = fmul(ibc.fdst[HIGH], ibc.fsrc[HIGH], vm.RoundingMode)
 		case VM_FDIV_M:
 			lo := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 0)))
 			high := float64(unsigned32ToSigned2sCompl(vm.Load32(ibc.getScratchpadAddress() + 4)))
@@ -798,45 +701,11 @@ func (vm *VM) InterpretByteCode() {
 			lo = math.Float64frombits((math.Float64bits(lo) & dynamicMantissaMask) | vm.config.eMask[LOW])
 			high = math.Float64frombits((math.Float64bits(high) & dynamicMantissaMask) | vm.config.eMask[HIGH])
 
-			//ibc.fdst[LOW] /= lo
-			//ibc.fdst[HIGH] /= high
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(lo)
-			vm.fresult.Quo(vm.fdst, vm.fsrc)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fsrc.SetPrec(0)
-			vm.fsrc.SetFloat64(high)
-			vm.fresult.Quo(vm.fdst, vm.fsrc)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			//panic("VM_FDIV_M")
+			ibc.fdst[LOW] = fdiv(ibc.fdst[LOW], lo, vm.RoundingMode)
+			ibc.fdst[HIGH] = fdiv(ibc.fdst[HIGH], high, vm.RoundingMode)
 		case VM_FSQRT_R:
-			// ibc.fdst[LOW] = math.Sqrt(ibc.fdst[LOW])
-			// ibc.fdst[HIGH] = math.Sqrt(ibc.fdst[HIGH])
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[LOW])
-			vm.fdst.SetMode(vm.RoundingMode)
-			vm.fresult.Sqrt(vm.fdst)
-			ibc.fdst[LOW], _ = vm.fresult.Float64()
-
-			vm.fresult.SetMode(vm.RoundingMode)
-			vm.fdst.SetPrec(0)
-			vm.fdst.SetFloat64(ibc.fdst[HIGH])
-			vm.fdst.SetMode(vm.RoundingMode)
-			vm.fresult.Sqrt(vm.fdst)
-			ibc.fdst[HIGH], _ = vm.fresult.Float64()
-
-			// panic("VM_FSQRT")
+			ibc.fdst[LOW] = fsqrt(ibc.fdst[LOW], vm.RoundingMode)
+			ibc.fdst[HIGH] = fsqrt(ibc.fdst[HIGH], vm.RoundingMode)
 		case VM_CBRANCH:
 			//fmt.Printf("pc %d  src  %x   imm %x\n",pc ,*ibc.isrc,  ibc.imm)
 			*ibc.isrc += ibc.imm
@@ -873,7 +742,7 @@ func (vm *VM) InterpretByteCode() {
 		case VM_NOP: // we do nothing
 
 		default:
-			panic("instruction not implemented")
+			raise(ErrInvalidInstruction, "opcode %d not implemented", ibc.Opcode)
 
 		}
 		/*fmt.Printf("REGS ")
@@ -886,4 +755,3 @@ func (vm *VM) InterpretByteCode() {
 	}
 }
 
-var umm888_ = fmt.Sprintf("")